@@ -0,0 +1,175 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const anyArch = "any"
+
+func checkArchs(archs []string) error {
+	if len(archs) == 0 {
+		return fmt.Errorf("no architectures")
+	}
+	for _, arch := range archs {
+		if !validArchName(arch) || arch == anyArch {
+			return fmt.Errorf("invalid architecture '%s'", arch)
+		}
+	}
+	return nil
+}
+
+func knownArch(arch string) bool {
+	return slices.Contains(serverCfg().Archs, arch)
+}
+
+func archPath(branchDir, arch string) string {
+	return filepath.Join(branchDir, arch)
+}
+
+func archDirs(branchDir, arch string) []string {
+	var dirs []string
+	for _, known := range serverCfg().Archs {
+		if arch == "" || arch == known {
+			dirs = append(dirs, archPath(branchDir, known))
+		}
+	}
+	return dirs
+}
+
+func archParam(c echo.Context) (string, bool) {
+	arch := c.QueryParam("arch")
+	return arch, arch == "" || knownArch(arch)
+}
+
+func targetArchs(pkgArch string) []string {
+	if pkgArch == anyArch {
+		return serverCfg().Archs
+	}
+	if knownArch(pkgArch) {
+		return []string{pkgArch}
+	}
+	return nil
+}
+
+func rebuildDatabases(dirs []string, branch string, rollback func()) error {
+	for i, dirPath := range dirs {
+		if rebuildErr := rebuildDatabase(dirPath, branch); rebuildErr != nil {
+			rollback()
+			for _, done := range dirs[:i] {
+				if restoreErr := rebuildDatabase(done, branch); restoreErr != nil {
+					logError(restoreErr, "Unable to restore database of '%s'", done)
+				}
+			}
+			return fmt.Errorf("unable to rebuild database of '%s': %s", dirPath, rebuildErr)
+		}
+	}
+	return nil
+}
+
+func migrateBranch(branchDir string) error {
+	entries, readErr := os.ReadDir(branchDir)
+	if readErr != nil {
+		return readErr
+	}
+	defaultDir := archPath(branchDir, serverCfg().Archs[0])
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && validArchName(name) {
+			continue
+		}
+		if strings.HasPrefix(name, "tmp_") || strings.HasPrefix(name, ".staging-") || name == uploadsDirName {
+			continue
+		}
+		if mkErr := os.MkdirAll(defaultDir, 0755); mkErr != nil {
+			return mkErr
+		}
+		logInfo("Moving '%s' to '%s'", filepath.Join(branchDir, name), defaultDir)
+		if renameErr := os.Rename(filepath.Join(branchDir, name), filepath.Join(defaultDir, name)); renameErr != nil {
+			return renameErr
+		}
+	}
+	for _, dirPath := range archDirs(branchDir, "") {
+		if mkErr := os.MkdirAll(dirPath, 0755); mkErr != nil {
+			return mkErr
+		}
+	}
+	return nil
+}
+
+const staleAge = time.Minute
+
+func isStale(name string) bool {
+	return strings.HasPrefix(name, "tmp_") && strings.HasSuffix(name, "_pmt") ||
+		strings.HasPrefix(name, ".staging-") ||
+		strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, sigExt+".tmp")
+}
+
+func sweepStale(branchDir string) {
+	for _, dirPath := range append([]string{branchDir}, archDirs(branchDir, "")...) {
+		entries, readErr := os.ReadDir(dirPath)
+		if readErr != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !isStale(entry.Name()) {
+				continue
+			}
+			info, infoErr := entry.Info()
+			if infoErr != nil || dirPath == branchDir && time.Since(info.ModTime()) < staleAge {
+				continue
+			}
+			path := filepath.Join(dirPath, entry.Name())
+			logInfo("Removing stale '%s'", path)
+			if rmErr := os.RemoveAll(path); rmErr != nil {
+				logError(rmErr, "Unable to remove '%s'", path)
+			}
+		}
+	}
+}
+
+func migrateBranches(rootDir string) error {
+	dirs, globErr := filepath.Glob(filepath.Join(rootDir, "*"))
+	if globErr != nil {
+		return globErr
+	}
+	for _, branchDir := range dirs {
+		if stat, statErr := os.Stat(branchDir); statErr != nil || !stat.IsDir() || strings.HasPrefix(filepath.Base(branchDir), ".") {
+			continue
+		}
+		unlock, lockErr := lockBranch(branchDir, true)
+		if lockErr != nil {
+			return lockErr
+		}
+		migrateErr := migrateBranch(branchDir)
+		if migrateErr == nil {
+			sweepStale(branchDir)
+		}
+		unlock()
+		if migrateErr != nil {
+			return fmt.Errorf("could not migrate branch '%s': %s", branchDir, migrateErr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	archiveDirName = ".archive"
+	archivePrefix  = 16
+)
+
+type pkgMove struct {
+	srcPath string
+	dstPath string
+}
+
+func archiveDir(branchDir string) string {
+	return filepath.Join(branchDir, archiveDirName)
+}
+
+func archivedName(entry *pkgEntry) string {
+	return entry.Sha256[:archivePrefix] + "_" + entry.Filename
+}
+
+func publishedName(name string) string {
+	prefix, rest, found := strings.Cut(name, "_")
+	if _, hexErr := hex.DecodeString(prefix); !found || len(prefix) != archivePrefix || hexErr != nil {
+		return name
+	}
+	return rest
+}
+
+func movePackage(srcPath, dstPath string) error {
+	logInfo("Moving '%s'=>'%s'", srcPath, dstPath)
+	if renameErr := os.Rename(srcPath, dstPath); renameErr != nil {
+		return renameErr
+	}
+	if _, statErr := os.Stat(srcPath + sigExt); statErr == nil {
+		if renameErr := os.Rename(srcPath+sigExt, dstPath+sigExt); renameErr != nil {
+			logError(renameErr, "Unable to move signature of '%s'", srcPath)
+		}
+	}
+	if _, statErr := os.Stat(cachePath(srcPath)); statErr != nil {
+		return nil
+	}
+	if mkErr := os.MkdirAll(filepath.Dir(cachePath(dstPath)), 0755); mkErr != nil {
+		logError(mkErr, "Unable to create cache directory for '%s'", dstPath)
+		return nil
+	}
+	if renameErr := os.Rename(cachePath(srcPath), cachePath(dstPath)); renameErr != nil {
+		logError(renameErr, "Unable to move cached metadata of '%s'", srcPath)
+		return nil
+	}
+	if filepath.Base(srcPath) != filepath.Base(dstPath) {
+		renameCachedEntry(dstPath)
+	}
+	return nil
+}
+
+func renameCachedEntry(path string) {
+	var entry pkgEntry
+	content, readErr := os.ReadFile(cachePath(path))
+	if readErr != nil || json.Unmarshal(content, &entry) != nil {
+		return
+	}
+	entry.Filename = filepath.Base(path)
+	if saveErr := saveCachedEntry(path, &entry); saveErr != nil {
+		logError(saveErr, "Unable to cache metadata of '%s'", path)
+	}
+}
+
+func rmPackage(path string) {
+	rmFile(path)
+	if _, statErr := os.Stat(path + sigExt); statErr == nil {
+		rmFile(path + sigExt)
+	}
+}
+
+func installPackage(branchDir, srcPath, name, pkgName string) (func(), error) {
+	pkgs, pkgsErr := loadPkgNames(branchDir)
+	if pkgsErr != nil {
+		return nil, pkgsErr
+	}
+	if mkErr := os.MkdirAll(archiveDir(branchDir), 0755); mkErr != nil {
+		return nil, mkErr
+	}
+	var moves []pkgMove
+	revert := func() {
+		for i := len(moves) - 1; i >= 0; i-- {
+			if moveErr := movePackage(moves[i].dstPath, moves[i].srcPath); moveErr != nil {
+				logError(moveErr, "Unable to move '%s' back to '%s'", moves[i].dstPath, moves[i].srcPath)
+			}
+		}
+	}
+	for _, path := range pkgs[pkgName] {
+		entry, entryErr := loadPkgEntry(path)
+		if entryErr != nil {
+			revert()
+			return nil, entryErr
+		}
+		archivedPath := filepath.Join(archiveDir(branchDir), archivedName(entry))
+		if moveErr := movePackage(path, archivedPath); moveErr != nil {
+			revert()
+			return nil, moveErr
+		}
+		moves = append(moves, pkgMove{path, archivedPath})
+	}
+	newPath := filepath.Join(branchDir, name)
+	if moveErr := movePackage(srcPath, newPath); moveErr != nil {
+		revert()
+		return nil, moveErr
+	}
+	moves = append(moves, pkgMove{srcPath, newPath})
+	return revert, nil
+}
+
+func archivedVersions(branchDir, pkgName string) ([]*pkgEntry, error) {
+	pkgs, pkgsErr := loadPkgNames(archiveDir(branchDir))
+	if pkgsErr != nil {
+		return nil, pkgsErr
+	}
+	var entries []*pkgEntry
+	for _, path := range pkgs[pkgName] {
+		entry, entryErr := loadPkgEntry(path)
+		if entryErr != nil {
+			return nil, entryErr
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime > entries[j].ModTime })
+	return entries, nil
+}
+
+func pruneArchive(branchDir, branch, pkgName string) {
+	entries, entriesErr := archivedVersions(branchDir, pkgName)
+	if entriesErr != nil {
+		logError(entriesErr, "Unable to load archived versions of '%s' in '%s'", pkgName, branchDir)
+		return
+	}
+	keep := policyFor(branch).retention()
+	if len(entries) <= keep {
+		return
+	}
+	for _, entry := range entries[keep:] {
+		rmPackage(filepath.Join(archiveDir(branchDir), entry.Filename))
+	}
+	pruneCache(archiveDir(branchDir))
+}
+
+func restoreArchived(dirPath, name, version string) (*pkgEntry, func(), error) {
+	pkgs, pkgsErr := loadPkgNames(dirPath)
+	if pkgsErr != nil {
+		return nil, nil, pkgsErr
+	}
+	var currentTime int64
+	var currentSums []string
+	for _, path := range pkgs[name] {
+		entry, entryErr := loadPkgEntry(path)
+		if entryErr != nil {
+			return nil, nil, entryErr
+		}
+		currentTime = max(currentTime, entry.ModTime)
+		currentSums = append(currentSums, entry.Sha256)
+	}
+	archived, archivedErr := archivedVersions(dirPath, name)
+	if archivedErr != nil {
+		return nil, nil, archivedErr
+	}
+	var target *pkgEntry
+	for _, entry := range archived {
+		if slices.Contains(currentSums, entry.Sha256) {
+			continue
+		}
+		if (version != "" && entry.Info.Version == version) || (version == "" && (currentTime == 0 || entry.ModTime < currentTime)) {
+			target = entry
+			break
+		}
+	}
+	if target == nil {
+		return nil, nil, nil
+	}
+	archivedPath := filepath.Join(archiveDir(dirPath), target.Filename)
+	restored := *target
+	restored.Filename = publishedName(target.Filename)
+	revert, installErr := installPackage(dirPath, archivedPath, restored.Filename, name)
+	if installErr != nil {
+		return nil, nil, installErr
+	}
+	return &restored, revert, nil
+}
+
+func rollbackPkgHandler(rootDir string, c echo.Context) error {
+	branch := c.Param("branch")
+	name := c.Param("name")
+	if branch == "" || name == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if !validPkgName(name) {
+		return rejectRequest(c, "package", name)
+	}
+	arch, archOk := archParam(c)
+	if !archOk {
+		return rejectRequest(c, "architecture", arch)
+	}
+	version := c.QueryParam("version")
+	branchDir := filepath.Join(rootDir, branch)
+	unlock, lockErr := lockBranch(branchDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	replaced := currentFiles(archDirs(branchDir, arch), name)
+	var dirs, restored []string
+	var files []auditFile
+	var reverts []func()
+	rollback := func() {
+		for i := len(reverts) - 1; i >= 0; i-- {
+			reverts[i]()
+		}
+	}
+	for _, dirPath := range archDirs(branchDir, arch) {
+		target, revert, restoreErr := restoreArchived(dirPath, name, version)
+		if restoreErr != nil {
+			logError(restoreErr, "Unable to restore '%s' in '%s'", name, dirPath)
+			rollback()
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if target == nil {
+			continue
+		}
+		reverts = append(reverts, revert)
+		dirs = append(dirs, dirPath)
+		if !slices.Contains(restored, target.Filename) {
+			restored = append(restored, target.Filename)
+			files = append(files, auditEntryFile(target))
+		}
+	}
+	if len(dirs) == 0 {
+		logInfo("No archived version '%s' of '%s' in '%s'", version, name, branchDir)
+		return c.NoContent(http.StatusNotFound)
+	}
+	if rebuildErr := rebuildDatabases(dirs, branch, rollback); rebuildErr != nil {
+		logError(rebuildErr, "Unable to rebuild databases of '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, dirPath := range dirs {
+		pruneArchive(dirPath, branch, name)
+	}
+	logInfo("Rolled back '%s' to '%s' in '%s'", name, strings.Join(restored, ", "), branchDir)
+	recordAudit(c, auditEntry{Action: auditPackageRollback, Branch: branch, Files: files, Replaced: replaced})
+	return c.String(http.StatusOK, strings.Join(restored, ", "))
+}
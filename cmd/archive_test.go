@@ -0,0 +1,151 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeTestPkg(t *testing.T, path, build string, modTime time.Time) string {
+	t.Helper()
+	fp, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	pkgTar := tar.NewWriter(fp)
+	files := []struct{ name, content string }{
+		{".PKGINFO", "pkgname = foo\npkgver = 1.0-1\narch = x86_64\n"},
+		{"usr/share/foo/build", build},
+	}
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), ModTime: modTime}
+		if writeErr := pkgTar.WriteHeader(header); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		if _, writeErr := pkgTar.Write([]byte(file.content)); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+	}
+	if closeErr := pkgTar.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if closeErr := fp.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if timeErr := os.Chtimes(path, modTime, modTime); timeErr != nil {
+		t.Fatal(timeErr)
+	}
+	entry, entryErr := loadPkgEntry(path)
+	if entryErr != nil {
+		t.Fatal(entryErr)
+	}
+	return entry.Sha256
+}
+
+func archivedSums(t *testing.T, dirPath string) []string {
+	t.Helper()
+	entries, entriesErr := archivedVersions(dirPath, "foo")
+	if entriesErr != nil {
+		t.Fatal(entriesErr)
+	}
+	var sums []string
+	for _, entry := range entries {
+		sums = append(sums, entry.Sha256)
+	}
+	return sums
+}
+
+func currentSum(t *testing.T, path string) string {
+	t.Helper()
+	entry, entryErr := loadPkgEntry(path)
+	if entryErr != nil {
+		t.Fatal(entryErr)
+	}
+	return entry.Sha256
+}
+
+func TestRollbackSameFilenameRebuild(t *testing.T) {
+	dirPath := t.TempDir()
+	name := "foo-1.0-1-x86_64.pkg.tar"
+	pkgPath := filepath.Join(dirPath, name)
+	now := time.Now()
+	first := writeTestPkg(t, pkgPath, "first", now.Add(-2*time.Hour))
+
+	tmpPath := filepath.Join(dirPath, "tmp_rebuild_pmt")
+	second := writeTestPkg(t, tmpPath, "second", now.Add(-time.Hour))
+	if _, installErr := installPackage(dirPath, tmpPath, name, "foo"); installErr != nil {
+		t.Fatal(installErr)
+	}
+	if sum := currentSum(t, pkgPath); sum != second {
+		t.Fatalf("current package is %s, want the rebuild %s", sum, second)
+	}
+	if sums := archivedSums(t, dirPath); !slices.Equal(sums, []string{first}) {
+		t.Fatalf("archive holds %v, want %v", sums, []string{first})
+	}
+
+	target, _, restoreErr := restoreArchived(dirPath, "foo", "")
+	if restoreErr != nil {
+		t.Fatal(restoreErr)
+	}
+	if target == nil {
+		t.Fatal("no archived version restored")
+	}
+	if target.Filename != name || target.Sha256 != first {
+		t.Errorf("restored %s (%s), want %s (%s)", target.Filename, target.Sha256, name, first)
+	}
+	if sum := currentSum(t, pkgPath); sum != first {
+		t.Errorf("current package is %s after the rollback, want %s", sum, first)
+	}
+	if sums := archivedSums(t, dirPath); !slices.Equal(sums, []string{second}) {
+		t.Errorf("archive holds %v after the rollback, want %v", sums, []string{second})
+	}
+
+	third := writeTestPkg(t, tmpPath, "third", now)
+	if _, installErr := installPackage(dirPath, tmpPath, name, "foo"); installErr != nil {
+		t.Fatal(installErr)
+	}
+	if sum := currentSum(t, pkgPath); sum != third {
+		t.Errorf("current package is %s, want the re-upload %s", sum, third)
+	}
+	sums := archivedSums(t, dirPath)
+	slices.Sort(sums)
+	want := []string{first, second}
+	slices.Sort(want)
+	if !slices.Equal(sums, want) {
+		t.Errorf("archive holds %v after the re-upload, want %v", sums, want)
+	}
+}
+
+func TestPublishedName(t *testing.T) {
+	tests := []struct {
+		name, published string
+	}{
+		{"0123456789abcdef_foo-1.0-1-x86_64.pkg.tar.zst", "foo-1.0-1-x86_64.pkg.tar.zst"},
+		{"foo-1.0-1-x86_64.pkg.tar.zst", "foo-1.0-1-x86_64.pkg.tar.zst"},
+		{"lib_foo-1.0-1-x86_64.pkg.tar.zst", "lib_foo-1.0-1-x86_64.pkg.tar.zst"},
+		{"0123456789abcdeg_foo-1.0-1-x86_64.pkg.tar.zst", "0123456789abcdeg_foo-1.0-1-x86_64.pkg.tar.zst"},
+	}
+	for _, test := range tests {
+		if published := publishedName(test.name); published != test.published {
+			t.Errorf("publishedName(%q) = %q, want %q", test.name, published, test.published)
+		}
+	}
+}
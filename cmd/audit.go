@@ -0,0 +1,222 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditBranchCreate    = "branch-create"
+	auditBranchRemove    = "branch-remove"
+	auditBranchRestore   = "branch-restore"
+	auditPackageAdd      = "package-add"
+	auditPackageRemove   = "package-remove"
+	auditPackagePromote  = "package-promote"
+	auditPackageMove     = "package-move"
+	auditPackageRollback = "package-rollback"
+)
+
+const defaultAuditLog = ".audit.jsonl"
+
+type auditFile struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type auditEntry struct {
+	Time     time.Time   `json:"time"`
+	Action   string      `json:"action"`
+	Branch   string      `json:"branch"`
+	From     string      `json:"from,omitempty"`
+	Identity string      `json:"identity"`
+	Remote   string      `json:"remote"`
+	Files    []auditFile `json:"files,omitempty"`
+	Replaced []string    `json:"replaced,omitempty"`
+}
+
+var auditLock sync.Mutex
+
+func auditLogPath() string {
+	cfg := serverCfg()
+	if cfg.AuditLog != "" {
+		return cfg.AuditLog
+	}
+	return filepath.Join(cfg.Root, defaultAuditLog)
+}
+
+func recordAudit(c echo.Context, entry auditEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Identity, _ = c.Get(identityKey).(string)
+	entry.Remote = c.RealIP()
+	line, jsonErr := json.Marshal(&entry)
+	if jsonErr != nil {
+		logError(jsonErr, "Unable to serialize audit entry")
+		return
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	filePath := auditLogPath()
+	fp, openErr := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if openErr != nil {
+		logError(openErr, "Unable to open audit log '%s'", filePath)
+		return
+	}
+	_, writeErr := fp.Write(append(line, '\n'))
+	if closeErr := fp.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		logError(writeErr, "Unable to write audit log '%s'", filePath)
+	}
+}
+
+func auditEntryFile(entry *pkgEntry) auditFile {
+	return auditFile{Name: entry.Filename, Sha256: entry.Sha256}
+}
+
+func appendAuditFile(files []auditFile, file auditFile) []auditFile {
+	if slices.ContainsFunc(files, func(other auditFile) bool { return other.Name == file.Name }) {
+		return files
+	}
+	return append(files, file)
+}
+
+func currentFiles(dirPaths []string, pkgName string) []string {
+	var files []string
+	for _, dirPath := range dirPaths {
+		pkgs, pkgsErr := loadPkgNames(dirPath)
+		if pkgsErr != nil {
+			logError(pkgsErr, "Unable to load pkg names from '%s'", dirPath)
+			continue
+		}
+		for _, path := range pkgs[pkgName] {
+			if !slices.Contains(files, filepath.Base(path)) {
+				files = append(files, filepath.Base(path))
+			}
+		}
+	}
+	return files
+}
+
+func auditBranch(c echo.Context) string {
+	return c.QueryParam("branch")
+}
+
+func parseSince(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, true
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if since, parseErr := time.ParseInLocation(layout, value, time.UTC); parseErr == nil {
+			return since, true
+		}
+	}
+	if duration, parseErr := time.ParseDuration(value); parseErr == nil && duration >= 0 {
+		return time.Now().Add(-duration), true
+	}
+	return time.Time{}, false
+}
+
+func formatAuditEntry(entry *auditEntry) string {
+	identity := entry.Identity
+	if identity == "" {
+		identity = "-"
+	}
+	result := fmt.Sprintf("%s %s '%s'", entry.Time.Format(time.RFC3339), entry.Action, entry.Branch)
+	if entry.From != "" {
+		result += fmt.Sprintf(" from '%s'", entry.From)
+	}
+	result += fmt.Sprintf(" by %s (%s)", identity, entry.Remote)
+	var files []string
+	for _, file := range entry.Files {
+		if file.Sha256 != "" {
+			files = append(files, fmt.Sprintf("%s (sha256 %s)", file.Name, file.Sha256))
+		} else {
+			files = append(files, file.Name)
+		}
+	}
+	if len(files) > 0 {
+		result += ": " + strings.Join(files, ", ")
+	}
+	if len(entry.Replaced) > 0 {
+		result += "; replaced " + strings.Join(entry.Replaced, ", ")
+	}
+	return result
+}
+
+func auditHandler(c echo.Context) error {
+	branch := auditBranch(c)
+	if branch != "" && !validBranchName(branch) {
+		return rejectRequest(c, "branch", branch)
+	}
+	since, sinceOk := parseSince(c.QueryParam("since"))
+	if !sinceOk {
+		return rejectRequest(c, "time", c.QueryParam("since"))
+	}
+	token, _ := c.Get(tokenKey).(*authToken)
+	entries := []*auditEntry{}
+	filePath := auditLogPath()
+	fp, openErr := os.Open(filePath)
+	if openErr != nil && !os.IsNotExist(openErr) {
+		logError(openErr, "Unable to open audit log '%s'", filePath)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if openErr == nil {
+		defer func() { _ = fp.Close() }()
+		scanner := bufio.NewScanner(fp)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry auditEntry
+			if jsonErr := json.Unmarshal(scanner.Bytes(), &entry); jsonErr != nil {
+				logError(jsonErr, "Skipping invalid line of audit log '%s'", filePath)
+				continue
+			}
+			if entry.Time.Before(since) || branch != "" && entry.Branch != branch && entry.From != branch {
+				continue
+			}
+			if token != nil && !token.allows(scopeAdmin, entry.Branch) && (entry.From == "" || !token.allows(scopeAdmin, entry.From)) {
+				continue
+			}
+			entries = append(entries, &entry)
+		}
+		if scanErr := scanner.Err(); scanErr != nil {
+			logError(scanErr, "Unable to read audit log '%s'", filePath)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if wantsJson(c) {
+		return c.JSON(http.StatusOK, entries)
+	}
+	var result []string
+	for _, entry := range entries {
+		result = append(result, formatAuditEntry(entry))
+	}
+	if len(result) == 0 {
+		return c.String(http.StatusOK, "No entries.")
+	}
+	return c.String(http.StatusOK, strings.Join(result, "\n"))
+}
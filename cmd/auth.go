@@ -0,0 +1,191 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type scope int
+
+const (
+	scopeRead scope = iota
+	scopeUpload
+	scopeDelete
+	scopeAdmin
+)
+
+const (
+	identityKey = "identity"
+	tokenKey    = "token"
+)
+
+var scopeNames = map[string]scope{
+	"read":   scopeRead,
+	"upload": scopeUpload,
+	"delete": scopeDelete,
+	"admin":  scopeAdmin,
+}
+
+type authToken struct {
+	Name         string   `toml:"name"`
+	Token        string   `toml:"token"`
+	Scope        string   `toml:"scope"`
+	Branches     []string `toml:"branches"`
+	Certificates []string `toml:"certificates"`
+	Anonymous    bool     `toml:"anonymous"`
+	level        scope
+}
+
+func loadTokens(filePath string) ([]authToken, error) {
+	var tokensFile struct {
+		Tokens []authToken `toml:"token"`
+	}
+	if _, decodeErr := toml.DecodeFile(filePath, &tokensFile); decodeErr != nil {
+		return nil, fmt.Errorf("could not parse toml from '%s': %s", filePath, decodeErr)
+	}
+	if len(tokensFile.Tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in '%s'", filePath)
+	}
+	if checkErr := checkTokens(tokensFile.Tokens, filePath); checkErr != nil {
+		return nil, checkErr
+	}
+	return tokensFile.Tokens, nil
+}
+
+func checkTokens(tokens []authToken, filePath string) error {
+	for i := range tokens {
+		token := &tokens[i]
+		if token.Name == "" {
+			return fmt.Errorf("token #%d in '%s' has no name", i+1, filePath)
+		}
+		if token.Anonymous && (token.Token != "" || len(token.Certificates) > 0) {
+			return fmt.Errorf("anonymous token '%s' in '%s' has a secret or certificates", token.Name, filePath)
+		}
+		if !token.Anonymous && token.Token == "" && len(token.Certificates) == 0 {
+			return fmt.Errorf("token '%s' in '%s' has neither a secret nor certificates", token.Name, filePath)
+		}
+		level, found := scopeNames[token.Scope]
+		if !found {
+			return fmt.Errorf("token '%s' in '%s' has invalid scope '%s'", token.Name, filePath, token.Scope)
+		}
+		token.level = level
+		for _, pattern := range token.Branches {
+			if _, matchErr := path.Match(pattern, ""); matchErr != nil {
+				return fmt.Errorf("token '%s' in '%s' has invalid branch glob '%s'", token.Name, filePath, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *authToken) allows(level scope, branch string) bool {
+	if t.level < level {
+		return false
+	}
+	if branch == "" {
+		return true
+	}
+	for _, pattern := range t.Branches {
+		if matched, _ := path.Match(pattern, branch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func findToken(tokens []authToken, secret string) *authToken {
+	for i := range tokens {
+		if tokens[i].Token == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(tokens[i].Token), []byte(secret)) == 1 {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+func findAnonymousToken(tokens []authToken) *authToken {
+	for i := range tokens {
+		if tokens[i].Anonymous {
+			return &tokens[i]
+		}
+	}
+	return nil
+}
+
+func bearerToken(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func branchParam(c echo.Context) string {
+	return c.Param("branch")
+}
+
+func nameParam(c echo.Context) string {
+	return c.QueryParam("name")
+}
+
+func noBranch(echo.Context) string {
+	return ""
+}
+
+func authMiddleware(level scope, branchOf func(echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cfg := serverCfg()
+			if !cfg.authEnabled {
+				return next(c)
+			}
+			secret := bearerToken(c)
+			var token *authToken
+			anonymous := false
+			if secret != "" {
+				token = findToken(cfg.Tokens, secret)
+			} else if token = findCertToken(cfg.Tokens, c.Request().TLS); token == nil {
+				token = findAnonymousToken(cfg.Tokens)
+				anonymous = true
+			}
+			if token == nil {
+				logInfo("Rejected unknown token from '%s' for '%s %s'", c.RealIP(), c.Request().Method, c.Request().URL)
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			if !token.allows(level, branchOf(c)) {
+				logInfo("Denied '%s %s' for '%s' from '%s'", c.Request().Method, c.Request().URL, token.Name, c.RealIP())
+				if anonymous {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+					return c.NoContent(http.StatusUnauthorized)
+				}
+				return c.NoContent(http.StatusForbidden)
+			}
+			c.Set(identityKey, token.Name)
+			c.Set(tokenKey, token)
+			return next(c)
+		}
+	}
+}
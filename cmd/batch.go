@@ -0,0 +1,146 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const batchPartName = "package"
+
+func addBatchHandler(rootDir string, c echo.Context) error {
+	branch := c.Param("branch")
+	if branch == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	branchDir := filepath.Join(rootDir, branch)
+	if _, statErr := os.Stat(branchDir); statErr != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	reader, readerErr := c.Request().MultipartReader()
+	if readerErr != nil {
+		logError(readerErr, "Rejected batch for '%s'", branch)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	var pending []*pendingPkg
+	defer func() {
+		for _, pkg := range pending {
+			rmPackage(pkg.tmpPath)
+		}
+	}()
+	var uploads []string
+	names := make(map[string]bool)
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		}
+		if partErr != nil {
+			logError(partErr, "Unable to read batch for '%s'", branch)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		var pkg *pendingPkg
+		var status int
+		switch part.FormName() {
+		case batchPartName:
+			name := part.FileName()
+			if !validPkgFile(name) {
+				return rejectRequest(c, "package file", name)
+			}
+			pkg, status = receivePackage(branchDir, branch, name, part, http.Header(part.Header))
+		case batchUploadPartName:
+			id, readErr := io.ReadAll(io.LimitReader(part, 64))
+			if readErr != nil {
+				logError(readErr, "Unable to read batch for '%s'", branch)
+				return c.NoContent(http.StatusBadRequest)
+			}
+			if pkg, status = receiveUpload(branchDir, branch, string(id)); pkg != nil {
+				uploads = append(uploads, string(id))
+			}
+		default:
+			_ = part.Close()
+			continue
+		}
+		if pkg == nil {
+			return c.NoContent(status)
+		}
+		pending = append(pending, pkg)
+		if names[pkg.entry.Filename] {
+			logInfo("Rejected batch for '%s': '%s' is sent twice", branch, pkg.entry.Filename)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		names[pkg.entry.Filename] = true
+	}
+	if len(pending) == 0 {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	pkgNames := make(map[string]string)
+	for _, pkg := range pending {
+		for _, arch := range pkg.archs {
+			key := arch + "/" + pkg.entry.Info.Name
+			if other, found := pkgNames[key]; found {
+				logInfo("Rejected batch for '%s': '%s' and '%s' are the same package", branch, other, pkg.entry.Filename)
+				return c.NoContent(http.StatusBadRequest)
+			}
+			pkgNames[key] = pkg.entry.Filename
+		}
+	}
+
+	unlock, lockErr := lockBranch(branchDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	var replaced []string
+	for _, pkg := range pending {
+		replaced = append(replaced, currentFiles(archDirs(branchDir, ""), pkg.entry.Info.Name)...)
+	}
+	dirs, rollback, installErr := installPending(branchDir, pending)
+	if installErr != nil {
+		logError(installErr, "Unable to install batch to '%s'", branch)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if quotaErr := checkQuota(branchDir, branch); quotaErr != nil {
+		rollback()
+		return quotaResponse(c, quotaErr)
+	}
+	if rebuildErr := rebuildDatabases(dirs, branch, rollback); rebuildErr != nil {
+		logError(rebuildErr, "Unable to rebuild databases of '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, id := range uploads {
+		rmUpload(branchDir, id)
+	}
+	var added []string
+	var files []auditFile
+	for _, pkg := range pending {
+		for _, arch := range pkg.archs {
+			pruneArchive(archPath(branchDir, arch), branch, pkg.entry.Info.Name)
+		}
+		added = append(added, pkg.entry.Filename)
+		files = append(files, auditEntryFile(pkg.entry))
+	}
+	logInfo("Added '%s' to '%s'", strings.Join(added, "', '"), branch)
+	recordAudit(c, auditEntry{Action: auditPackageAdd, Branch: branch, Files: files, Replaced: replaced})
+	return c.NoContent(http.StatusCreated)
+}
@@ -23,40 +23,109 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 func addBranchHandler(rootDir string, c echo.Context) error {
 	name := c.QueryParam("name")
-	if name == "" {
-		return c.NoContent(http.StatusBadRequest)
+	if !validBranchName(name) {
+		return rejectRequest(c, "branch", name)
 	}
-	dirPath := filepath.Join(rootDir, name)
-	logInfo("Creating branch directory '%s'", dirPath)
-	if mkErr := os.MkdirAll(dirPath, 0755); mkErr != nil && !os.IsExist(mkErr) {
-		logError(mkErr, "Unable to create directory '%s'", dirPath)
+	branchDir := filepath.Join(rootDir, name)
+	unlock, lockErr := lockBranch(rootDir, false)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", rootDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer unlock()
+	logInfo("Creating branch directory '%s'", branchDir)
+	mkErr := os.Mkdir(branchDir, 0755)
+	if mkErr != nil && !os.IsExist(mkErr) {
+		logError(mkErr, "Unable to create directory '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, dirPath := range archDirs(branchDir, "") {
+		if mkErr := os.MkdirAll(dirPath, 0755); mkErr != nil && !os.IsExist(mkErr) {
+			logError(mkErr, "Unable to create directory '%s'", dirPath)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if mkErr == nil {
+		recordAudit(c, auditEntry{Action: auditBranchCreate, Branch: name})
+	}
 	return c.NoContent(http.StatusCreated)
 }
 
+type branchSummary struct {
+	Name     string    `json:"name"`
+	Packages int       `json:"packages"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Archs    []string  `json:"archs"`
+}
+
+func summarizeBranch(branchDir string) (*branchSummary, error) {
+	dirStat, dirErr := os.Stat(branchDir)
+	if dirErr != nil {
+		return nil, dirErr
+	}
+	paths := make(map[string]string)
+	for _, dirPath := range archDirs(branchDir, "") {
+		dirPaths, globErr := globPkgs(dirPath)
+		if globErr != nil {
+			return nil, globErr
+		}
+		for _, path := range dirPaths {
+			paths[filepath.Base(path)] = path
+		}
+	}
+	summary := branchSummary{
+		Name:     filepath.Base(branchDir),
+		Packages: len(paths),
+		Modified: dirStat.ModTime().UTC(),
+		Archs:    serverCfg().Archs,
+	}
+	for _, path := range paths {
+		stat, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, statErr
+		}
+		summary.Size += stat.Size()
+		if stat.ModTime().After(summary.Modified) {
+			summary.Modified = stat.ModTime().UTC()
+		}
+	}
+	return &summary, nil
+}
+
 func lsBranchesHandler(rootDir string, c echo.Context) error {
 	dirs, rootGlobErr := filepath.Glob(filepath.Join(rootDir, "*"))
 	if rootGlobErr != nil {
 		logError(rootGlobErr, "Unable to glob root directory '%s'", rootDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	var result []string
+	summaries := []*branchSummary{}
 	for _, branchDir := range dirs {
-		paths, brGlobErr := filepath.Glob(filepath.Join(branchDir, pkgWildcard))
-		if brGlobErr != nil {
-			logError(brGlobErr, "Unable to glob pkg directory '%s'", branchDir)
-			return c.NoContent(http.StatusBadRequest)
+		if strings.HasPrefix(filepath.Base(branchDir), ".") {
+			continue
+		}
+		summary, summaryErr := summarizeBranch(branchDir)
+		if summaryErr != nil {
+			logError(summaryErr, "Unable to summarize branch directory '%s'", branchDir)
+			return c.NoContent(http.StatusInternalServerError)
 		}
-		result = append(result, fmt.Sprintf("%s: %d item(s)", filepath.Base(branchDir), len(paths)))
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Name < summaries[j].Name })
+	if wantsJson(c) {
+		return c.JSON(http.StatusOK, summaries)
+	}
+	var result []string
+	for _, summary := range summaries {
+		result = append(result, fmt.Sprintf("%s: %d item(s)", summary.Name, summary.Packages))
 	}
 	if len(result) == 0 {
 		return c.String(http.StatusOK, "No entries.")
 	}
-	sort.Strings(result)
 	return c.String(http.StatusOK, strings.Join(result, "\n"))
 }
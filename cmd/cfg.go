@@ -16,28 +16,72 @@ package main
 */
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"net/http"
 	"os"
 	"strings"
 )
 
-const configPath = "~/.config/arpm.toml"
+const (
+	configPath = "~/.config/arpm.toml"
+	outputText = "text"
+	outputJson = "json"
+)
 
-var serverUri string
+var (
+	serverUri    string
+	serverToken  string
+	outputFormat = outputText
+	httpClient   *http.Client
+)
 
 func loadConfig() error {
+	if outputFormat != outputText && outputFormat != outputJson {
+		return fmt.Errorf("unknown output format '%s'", outputFormat)
+	}
 	homeDir, homeErr := os.UserHomeDir()
 	if homeErr != nil {
 		return fmt.Errorf("could not get home directory from '%s': %s", configPath, homeErr)
 	}
 	var config struct {
-		Uri string `toml:"server"`
+		Uri        string `toml:"server"`
+		Token      string `toml:"token"`
+		CABundle   string `toml:"ca_bundle"`
+		ClientCert string `toml:"client_cert"`
+		ClientKey  string `toml:"client_key"`
 	}
 	_, decodeErr := toml.DecodeFile(strings.Replace(configPath, "~", homeDir, 1), &config)
 	if decodeErr != nil {
 		return fmt.Errorf("could not parse toml from '%s': %s", configPath, decodeErr)
 	}
 	serverUri = config.Uri
+	serverToken = config.Token
+	if config.CABundle != "" || config.ClientCert != "" {
+		expand := func(path string) string { return strings.Replace(path, "~", homeDir, 1) }
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if config.CABundle != "" {
+			pool, poolErr := readCertPool(expand(config.CABundle))
+			if poolErr != nil {
+				return fmt.Errorf("could not read CA bundle from '%s': %s", config.CABundle, poolErr)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if config.ClientCert != "" {
+			keyPath := config.ClientKey
+			if keyPath == "" {
+				keyPath = config.ClientCert
+			}
+			cert, certErr := tls.LoadX509KeyPair(expand(config.ClientCert), expand(keyPath))
+			if certErr != nil {
+				return fmt.Errorf("could not load client certificate from '%s': %s", config.ClientCert, certErr)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		httpClient = &http.Client{Transport: transport}
+	}
 	return nil
 }
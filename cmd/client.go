@@ -16,68 +16,448 @@ package main
 */
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/carlmjohnson/requests"
+	"github.com/labstack/echo/v4"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+func newRequest() *requests.Builder {
+	builder := requests.URL(serverUri)
+	if httpClient != nil {
+		builder.Client(httpClient)
+	}
+	if serverToken != "" {
+		builder.Bearer(serverToken)
+	}
+	if outputFormat == outputJson {
+		builder.Accept(echo.MIMEApplicationJSON)
+	}
+	return builder
+}
+
+func printResult(result string) {
+	if outputFormat == outputJson {
+		var buffer bytes.Buffer
+		if json.Indent(&buffer, []byte(result), "", "  ") == nil {
+			result = buffer.String()
+		}
+	}
+	fmt.Println(strings.TrimRight(result, "\n"))
+}
+
 func listBranches() error {
 	var result string
-	err := requests.
-		URL(serverUri).Path("branches").
+	err := newRequest().
+		Path("branches").
 		ToString(&result).Fetch(context.Background())
 	if err == nil {
-		fmt.Println(result)
+		printResult(result)
 	}
 	return err
 }
 
 func createBranch(name string) error {
-	return requests.
-		URL(serverUri).Path("branches").Param("name", name).
+	return newRequest().
+		Path("branches").Param("name", name).
 		Post().Fetch(context.Background())
 }
 
-func listPackages(branch string) error {
+func removeBranch(name string, force bool) error {
+	if !force {
+		fmt.Printf("Remove branch '%s'? [y/N] ", name)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return fmt.Errorf("cancelled")
+		}
+	}
+	var result string
+	err := newRequest().
+		Path("branches").Param("name", name).
+		Delete().ToString(&result).Fetch(context.Background())
+	if err == nil {
+		fmt.Printf("Moved to the trash as '%s'.\n", result)
+	}
+	return err
+}
+
+func listTrash() error {
 	var result string
-	err := requests.
-		URL(serverUri).Pathf("packages/%s", branch).
+	err := newRequest().
+		Path("branches/trash").
 		ToString(&result).Fetch(context.Background())
 	if err == nil {
-		fmt.Println(result)
+		printResult(result)
 	}
 	return err
 }
 
-func getPackage(branch string, name string) error {
-	return requests.
-		URL(serverUri).Pathf("packages/%s", branch).Param("name", name).
-		ToFile(name).Fetch(context.Background())
+func showAudit(branch, since string) error {
+	request := newRequest().Path("audit")
+	if branch != "" {
+		request.Param("branch", branch)
+	}
+	if since != "" {
+		request.Param("since", since)
+	}
+	var result string
+	err := request.ToString(&result).Fetch(context.Background())
+	if err == nil {
+		printResult(result)
+	}
+	return err
 }
 
-func putPackages(branch string, names []string) error {
+func restoreBranch(name string) error {
+	var result string
+	err := newRequest().
+		Path("branches/restore").Param("name", name).
+		Post().ToString(&result).Fetch(context.Background())
+	if err == nil {
+		fmt.Printf("Restored '%s'.\n", result)
+	}
+	return err
+}
+
+func listPackages(branch string, arch string) error {
+	var result string
+	err := newRequest().
+		Pathf("packages/%s", branch).ParamOptional("arch", arch).
+		ToString(&result).Fetch(context.Background())
+	if err == nil {
+		printResult(result)
+	}
+	return err
+}
+
+func fetchSummaries(branch string, arch string) ([]pkgSummary, error) {
+	var summaries []pkgSummary
+	err := newRequest().
+		Pathf("packages/%s", branch).ParamOptional("arch", arch).
+		Accept(echo.MIMEApplicationJSON).ToJSON(&summaries).Fetch(context.Background())
+	return summaries, err
+}
+
+func resolvePackages(summaries []pkgSummary, names []string) ([]pkgSummary, error) {
+	var result []pkgSummary
 	for _, name := range names {
-		err := requests.
-			URL(serverUri).Pathf("packages/%s", branch).
-			Param("name", filepath.Base(name)).
-			BodyFile(name).
-			Fetch(context.Background())
-		if err != nil {
-			return err
+		found := false
+		for _, summary := range summaries {
+			if summary.Filename == name || summary.Name == name {
+				result = append(result, summary)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no package '%s' in the branch", name)
+		}
+	}
+	return result, nil
+}
+
+func downloadPackage(branch string, summary pkgSummary, arch string, path string) (bool, error) {
+	if stat, statErr := os.Stat(path); statErr == nil {
+		if stat.Size() == summary.Size && stat.ModTime().Equal(summary.Uploaded) {
+			return false, nil
+		}
+		if checksum, sumErr := fileSha256(path); sumErr == nil && checksum == summary.Sha256 {
+			return false, os.Chtimes(path, summary.Uploaded, summary.Uploaded)
 		}
 	}
+	tmpPath := path + ".part"
+	fp, createErr := os.Create(tmpPath)
+	if createErr != nil {
+		return false, createErr
+	}
+	hash := sha256.New()
+	fetchErr := newRequest().
+		Pathf("packages/%s", branch).Param("name", summary.Filename).ParamOptional("arch", arch).
+		ToWriter(io.MultiWriter(fp, hash)).Fetch(context.Background())
+	if closeErr := fp.Close(); fetchErr == nil {
+		fetchErr = closeErr
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); fetchErr == nil && checksum != summary.Sha256 {
+		fetchErr = fmt.Errorf("checksum mismatch of '%s': expected %s, got %s", summary.Filename, summary.Sha256, checksum)
+	}
+	if fetchErr == nil {
+		fetchErr = os.Chtimes(tmpPath, summary.Uploaded, summary.Uploaded)
+	}
+	if fetchErr != nil {
+		_ = os.Remove(tmpPath)
+		return false, fetchErr
+	}
+	if renameErr := os.Rename(tmpPath, path); renameErr != nil {
+		return false, renameErr
+	}
+	fmt.Printf("Downloaded '%s'.\n", path)
+	return true, nil
+}
+
+func downloadPackages(branch string, summaries []pkgSummary, arch string, dirPath string, jobs int,
+	done func(pkgSummary)) error {
+	queue := make(chan pkgSummary)
+	errs := make(chan error, len(summaries))
+	var wg sync.WaitGroup
+	for i := 0; i < max(jobs, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for summary := range queue {
+				downloaded, downloadErr := downloadPackage(branch, summary, arch, filepath.Join(dirPath, summary.Filename))
+				if downloadErr != nil {
+					logError(downloadErr, "Failed to download '%s'", summary.Filename)
+					errs <- downloadErr
+				} else if downloaded && done != nil {
+					done(summary)
+				}
+			}
+		}()
+	}
+	queued := make(map[string]bool)
+	for _, summary := range summaries {
+		if !queued[summary.Filename] {
+			queued[summary.Filename] = true
+			queue <- summary
+		}
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d package(s) failed to download", len(errs), len(queued))
+	}
 	return nil
 }
 
+func getPackages(branch string, names []string, all bool, arch string, dirPath string, jobs int) error {
+	if all == (len(names) > 0) {
+		return fmt.Errorf("either package names or --all are required")
+	}
+	summaries, listErr := fetchSummaries(branch, arch)
+	if listErr != nil {
+		return listErr
+	}
+	if !all {
+		var resolveErr error
+		if summaries, resolveErr = resolvePackages(summaries, names); resolveErr != nil {
+			return resolveErr
+		}
+	}
+	if mkErr := os.MkdirAll(dirPath, 0755); mkErr != nil {
+		return mkErr
+	}
+	return downloadPackages(branch, summaries, arch, dirPath, jobs, nil)
+}
+
+func showPackage(branch string, name string, arch string) error {
+	var result string
+	err := newRequest().
+		Pathf("packages/%s/%s/info", branch, name).ParamOptional("arch", arch).
+		ToString(&result).Fetch(context.Background())
+	if err == nil {
+		printResult(result)
+	}
+	return err
+}
+
+func fileSha256(path string) (string, error) {
+	fp, openErr := os.Open(path)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer func() { _ = fp.Close() }()
+	hash := sha256.New()
+	if _, readErr := io.Copy(hash, fp); readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+const uploadRetries = 5
+
+func readSignature(path string) string {
+	signature, readErr := os.ReadFile(path + sigExt)
+	if readErr != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+func queryOffset(branch, id string) (int64, error) {
+	header := make(http.Header)
+	if headErr := newRequest().Pathf("uploads/%s/%s", branch, id).ToHeaders(header).Fetch(context.Background()); headErr != nil {
+		return 0, headErr
+	}
+	return strconv.ParseInt(header.Get(offsetHeader), 10, 64)
+}
+
+func uploadChunked(branch, path, checksum string, size int64) (string, error) {
+	var id string
+	header := make(http.Header)
+	createErr := newRequest().
+		Pathf("uploads/%s", branch).
+		Param("name", filepath.Base(path)).Param("size", strconv.FormatInt(size, 10)).
+		Header(checksumHeader, checksum).HeaderOptional(signatureHeader, readSignature(path)).
+		Post().CopyHeaders(header).CheckStatus(http.StatusOK, http.StatusCreated).
+		ToString(&id).Fetch(context.Background())
+	if createErr != nil {
+		return "", createErr
+	}
+	offset, parseErr := strconv.ParseInt(header.Get(offsetHeader), 10, 64)
+	if parseErr != nil {
+		return "", fmt.Errorf("invalid upload offset '%s': %s", header.Get(offsetHeader), parseErr)
+	}
+	if offset > 0 {
+		fmt.Printf("Resuming '%s' at %d of %d bytes.\n", path, offset, size)
+	}
+	fp, openErr := os.Open(path)
+	if openErr != nil {
+		return "", openErr
+	}
+	defer func() { _ = fp.Close() }()
+	failures := 0
+	for offset < size {
+		length := min(int64(fileChunkSize), size-offset)
+		putErr := newRequest().
+			Pathf("uploads/%s/%s", branch, id).Param("offset", strconv.FormatInt(offset, 10)).
+			ContentType("application/octet-stream").BodyReader(io.NewSectionReader(fp, offset, length)).
+			Put().Fetch(context.Background())
+		if putErr == nil {
+			offset += length
+			failures = 0
+			continue
+		}
+		if failures++; failures > uploadRetries {
+			return "", putErr
+		}
+		logError(putErr, "Failed to upload '%s' at %d, retrying", path, offset)
+		time.Sleep(time.Duration(failures) * time.Second)
+		if current, queryErr := queryOffset(branch, id); queryErr == nil {
+			offset = current
+		}
+	}
+	return id, nil
+}
+
+func writeBatch(writer *multipart.Writer, paths []string, checksums, uploads map[string]string) error {
+	for _, path := range paths {
+		if id, found := uploads[path]; found {
+			if fieldErr := writer.WriteField(batchUploadPartName, id); fieldErr != nil {
+				return fieldErr
+			}
+			continue
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, batchPartName, filepath.Base(path)))
+		header.Set("Content-Type", "application/octet-stream")
+		header.Set(checksumHeader, checksums[path])
+		if signature := readSignature(path); signature != "" {
+			header.Set(signatureHeader, signature)
+		}
+		part, partErr := writer.CreatePart(header)
+		if partErr != nil {
+			return partErr
+		}
+		fp, openErr := os.Open(path)
+		if openErr != nil {
+			return openErr
+		}
+		_, copyErr := io.Copy(part, fp)
+		_ = fp.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+	}
+	return writer.Close()
+}
+
+func putPackages(branch string, names []string) error {
+	var paths []string
+	checksums := make(map[string]string)
+	uploads := make(map[string]string)
+	for _, name := range names {
+		if strings.HasSuffix(name, sigExt) {
+			continue
+		}
+		stat, statErr := os.Stat(name)
+		if statErr != nil {
+			return statErr
+		}
+		checksum, sumErr := fileSha256(name)
+		if sumErr != nil {
+			return sumErr
+		}
+		if stat.Size() > fileChunkSize {
+			id, uploadErr := uploadChunked(branch, name, checksum, stat.Size())
+			if uploadErr != nil {
+				return uploadErr
+			}
+			uploads[name] = id
+		}
+		paths = append(paths, name)
+		checksums[name] = checksum
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no packages to upload")
+	}
+	boundary := multipart.NewWriter(nil).Boundary()
+	return newRequest().
+		Pathf("packages/%s/batch", branch).
+		ContentType("multipart/form-data; boundary=" + boundary).
+		BodyWriter(func(w io.Writer) error {
+			writer := multipart.NewWriter(w)
+			if boundaryErr := writer.SetBoundary(boundary); boundaryErr != nil {
+				return boundaryErr
+			}
+			return writeBatch(writer, paths, checksums, uploads)
+		}).
+		Fetch(context.Background())
+}
+
+func rollbackPackage(branch string, name string, version string) error {
+	var result string
+	err := newRequest().
+		Pathf("packages/%s/%s/rollback", branch, name).ParamOptional("version", version).
+		Post().ToString(&result).Fetch(context.Background())
+	if err == nil {
+		fmt.Printf("Restored '%s'.\n", result)
+	}
+	return err
+}
+
+func promotePackages(from string, to string, names []string, move bool) error {
+	request := newRequest().
+		Pathf("packages/%s/promote", to).
+		Param("from", from).Param("name", strings.Join(names, ","))
+	if move {
+		request.Param("move", "true")
+	}
+	return request.Post().Fetch(context.Background())
+}
+
 func rmPackages(branch string, orgNames []string) error {
 	var names []string
 	for _, name := range orgNames {
 		names = append(names, filepath.Base(name))
 	}
 	param := strings.Join(names, ",")
-	return requests.
-		URL(serverUri).Pathf("packages/%s", branch).Param("name", param).
+	return newRequest().
+		Pathf("packages/%s", branch).Param("name", param).
 		Delete().Fetch(context.Background())
 }
@@ -0,0 +1,143 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/DataDog/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var pkgExts = []string{
+	".pkg.tar",
+	".pkg.tar.gz",
+	".pkg.tar.bz2",
+	".pkg.tar.xz",
+	".pkg.tar.zst",
+	".pkg.tar.lzo",
+	".pkg.tar.lrz",
+	".pkg.tar.lz4",
+	".pkg.tar.lz",
+	".pkg.tar.Z",
+}
+
+func isPkgFile(name string) bool {
+	for _, ext := range pkgExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func globPkgs(dirPath string) ([]string, error) {
+	paths, globErr := filepath.Glob(filepath.Join(dirPath, "*.pkg.tar*"))
+	if globErr != nil {
+		return nil, globErr
+	}
+	var result []string
+	for _, path := range paths {
+		if isPkgFile(path) {
+			result = append(result, path)
+		}
+	}
+	return result, nil
+}
+
+type cmdReader struct {
+	stdout io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	done   bool
+}
+
+func (r *cmdReader) Read(buffer []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	count, readErr := r.stdout.Read(buffer)
+	if readErr == io.EOF {
+		r.done = true
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return count, fmt.Errorf("%s failed: %s: %s", r.cmd.Path, waitErr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	return count, readErr
+}
+
+func (r *cmdReader) Close() error {
+	if r.done {
+		return nil
+	}
+	r.done = true
+	_ = r.stdout.Close()
+	_ = r.cmd.Process.Kill()
+	_ = r.cmd.Wait()
+	return nil
+}
+
+func runDecompressor(reader io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	result := cmdReader{cmd: exec.Command(name, args...)}
+	result.cmd.Stdin = reader
+	result.cmd.Stderr = &result.stderr
+	stdout, pipeErr := result.cmd.StdoutPipe()
+	if pipeErr != nil {
+		return nil, pipeErr
+	}
+	result.stdout = stdout
+	if startErr := result.cmd.Start(); startErr != nil {
+		return nil, fmt.Errorf("could not run '%s': %s", name, startErr)
+	}
+	return &result, nil
+}
+
+func decompress(reader *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := reader.Peek(9)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return zstd.NewReader(reader), nil
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(reader)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(reader)), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xzReader, xzErr := xz.NewReader(reader)
+		if xzErr != nil {
+			return nil, xzErr
+		}
+		return io.NopCloser(xzReader), nil
+	case bytes.HasPrefix(magic, []byte{0x04, 0x22, 0x4d, 0x18}):
+		return io.NopCloser(lz4.NewReader(reader)), nil
+	case bytes.HasPrefix(magic, []byte("LZIP")):
+		return runDecompressor(reader, "lzip", "-d", "-c")
+	case bytes.HasPrefix(magic, []byte("LRZI")):
+		return runDecompressor(reader, "lrzip", "-d", "-q")
+	case bytes.HasPrefix(magic, []byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a}):
+		return runDecompressor(reader, "lzop", "-d", "-c")
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x9d}):
+		return runDecompressor(reader, "gzip", "-d", "-c")
+	}
+	return io.NopCloser(reader), nil
+}
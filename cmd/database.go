@@ -0,0 +1,137 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func formatDesc(entry *pkgEntry) string {
+	var builder strings.Builder
+	add := func(key string, values ...string) {
+		var nonEmpty []string
+		for _, value := range values {
+			if value != "" {
+				nonEmpty = append(nonEmpty, value)
+			}
+		}
+		if len(nonEmpty) == 0 {
+			return
+		}
+		builder.WriteString("%" + key + "%\n")
+		for _, value := range nonEmpty {
+			builder.WriteString(value + "\n")
+		}
+		builder.WriteString("\n")
+	}
+	info := &entry.Info
+	add("FILENAME", entry.Filename)
+	add("NAME", info.Name)
+	add("BASE", info.Base)
+	add("VERSION", info.Version)
+	add("DESC", info.Desc)
+	add("GROUPS", info.Groups...)
+	add("CSIZE", strconv.FormatInt(entry.FileSize, 10))
+	add("ISIZE", strconv.FormatInt(info.Size, 10))
+	add("MD5SUM", entry.Md5)
+	add("SHA256SUM", entry.Sha256)
+	add("PGPSIG", entry.PgpSig)
+	add("URL", info.Url)
+	add("LICENSE", info.Licenses...)
+	add("ARCH", info.Arch)
+	add("BUILDDATE", strconv.FormatInt(info.BuildDate, 10))
+	add("PACKAGER", info.Packager)
+	add("REPLACES", info.Replaces...)
+	add("CONFLICTS", info.Conflicts...)
+	add("PROVIDES", info.Provides...)
+	add("DEPENDS", info.Depends...)
+	add("OPTDEPENDS", info.OptDepends...)
+	add("MAKEDEPENDS", info.MakeDepends...)
+	add("CHECKDEPENDS", info.CheckDepends...)
+	return builder.String()
+}
+
+func formatFiles(entry *pkgEntry) string {
+	var builder strings.Builder
+	builder.WriteString("%FILES%\n")
+	for _, name := range entry.Files {
+		builder.WriteString(name + "\n")
+	}
+	return builder.String()
+}
+
+func writeDatabase(path string, entries []*pkgEntry, withFiles bool) (writeErr error) {
+	fp, fpErr := os.Create(path)
+	if fpErr != nil {
+		return fpErr
+	}
+	defer func() {
+		if closeErr := fp.Close(); closeErr != nil && writeErr == nil {
+			writeErr = closeErr
+		}
+	}()
+	buffer := bufio.NewWriterSize(fp, fileChunkSize)
+	zipper := gzip.NewWriter(buffer)
+	dbTar := tar.NewWriter(zipper)
+
+	sorted := append([]*pkgEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Info.Name < sorted[j].Info.Name })
+	now := time.Now()
+
+	addFile := func(name, content string) error {
+		header := tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: now, Typeflag: tar.TypeReg}
+		if headerErr := dbTar.WriteHeader(&header); headerErr != nil {
+			return headerErr
+		}
+		_, contentErr := dbTar.Write([]byte(content))
+		return contentErr
+	}
+
+	for _, entry := range sorted {
+		dirName := fmt.Sprintf("%s-%s/", entry.Info.Name, entry.Info.Version)
+		header := tar.Header{Name: dirName, Mode: 0755, ModTime: now, Typeflag: tar.TypeDir}
+		if headerErr := dbTar.WriteHeader(&header); headerErr != nil {
+			return headerErr
+		}
+		if descErr := addFile(dirName+"desc", formatDesc(entry)); descErr != nil {
+			return descErr
+		}
+		if withFiles {
+			if filesErr := addFile(dirName+"files", formatFiles(entry)); filesErr != nil {
+				return filesErr
+			}
+		}
+	}
+
+	if tarErr := dbTar.Close(); tarErr != nil {
+		return tarErr
+	}
+	if zipErr := zipper.Close(); zipErr != nil {
+		return zipErr
+	}
+	if flushErr := buffer.Flush(); flushErr != nil {
+		return flushErr
+	}
+	return fp.Sync()
+}
@@ -1,24 +1,30 @@
 module checkargs
 
-go 1.22
+go 1.22.0
 
-require github.com/spf13/cobra v1.8.0
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/DataDog/zstd v1.5.6
+	github.com/ProtonMail/go-crypto v1.3.0
+	github.com/carlmjohnson/requests v0.24.3
+	github.com/labstack/echo/v4 v4.13.3
+	github.com/pierrec/lz4/v4 v4.1.31
+	github.com/spf13/cobra v1.8.0
+	github.com/ulikunitz/xz v0.5.15
+)
 
 require (
-	github.com/BurntSushi/toml v1.5.0 // indirect
-	github.com/DataDog/zstd v1.5.6 // indirect
-	github.com/carlmjohnson/requests v0.24.3 // indirect
+	github.com/cloudflare/circl v1.6.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/labstack/echo/v4 v4.13.3 // indirect
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/net v0.33.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 	golang.org/x/time v0.8.0 // indirect
 )
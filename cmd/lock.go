@@ -0,0 +1,178 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+var (
+	branchMutexesLock sync.Mutex
+	branchMutexes     = make(map[string]*sync.RWMutex)
+
+	sessionMutexesLock sync.Mutex
+	sessionMutexes     = make(map[string]*sessionMutex)
+
+	writersLock sync.Mutex
+	writersIdle = sync.NewCond(&writersLock)
+	writers     int
+	draining    bool
+)
+
+var errDraining = errors.New("the server is shutting down")
+
+func branchMutex(dirPath string) *sync.RWMutex {
+	branchMutexesLock.Lock()
+	defer branchMutexesLock.Unlock()
+	mutex, found := branchMutexes[dirPath]
+	if !found {
+		mutex = &sync.RWMutex{}
+		branchMutexes[dirPath] = mutex
+	}
+	return mutex
+}
+
+type sessionMutex struct {
+	sync.RWMutex
+	holders int
+}
+
+func acquireSessionMutex(dirPath string) *sessionMutex {
+	sessionMutexesLock.Lock()
+	defer sessionMutexesLock.Unlock()
+	mutex, found := sessionMutexes[dirPath]
+	if !found {
+		mutex = &sessionMutex{}
+		sessionMutexes[dirPath] = mutex
+	}
+	mutex.holders++
+	return mutex
+}
+
+func releaseSessionMutex(dirPath string) {
+	sessionMutexesLock.Lock()
+	defer sessionMutexesLock.Unlock()
+	mutex := sessionMutexes[dirPath]
+	mutex.holders--
+	if mutex.holders == 0 {
+		delete(sessionMutexes, dirPath)
+	}
+}
+
+func flock(fd uintptr, how int) error {
+	for {
+		if lockErr := syscall.Flock(int(fd), how); lockErr != syscall.EINTR {
+			return lockErr
+		}
+	}
+}
+
+func lockBranch(dirPath string, exclusive bool) (func(), error) {
+	dirPath = filepath.Clean(dirPath)
+	mutex := branchMutex(dirPath)
+	lock, unlock, how := mutex.RLock, mutex.RUnlock, syscall.LOCK_SH
+	if exclusive {
+		if !addWriter() {
+			return nil, errDraining
+		}
+		lock, unlock, how = mutex.Lock, func() { mutex.Unlock(); removeWriter() }, syscall.LOCK_EX
+	}
+	lock()
+	release, lockErr := lockDir(dirPath, how)
+	if lockErr != nil {
+		unlock()
+		return nil, lockErr
+	}
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
+
+func lockSession(dirPath string, exclusive bool) (func(), error) {
+	dirPath = filepath.Clean(dirPath)
+	mutex := acquireSessionMutex(dirPath)
+	lock, unlock, how := mutex.RLock, mutex.RUnlock, syscall.LOCK_SH
+	if exclusive {
+		lock, unlock, how = mutex.Lock, mutex.Unlock, syscall.LOCK_EX
+	}
+	lock()
+	release, lockErr := lockDir(dirPath, how)
+	if lockErr != nil {
+		unlock()
+		releaseSessionMutex(dirPath)
+		return nil, lockErr
+	}
+	return func() {
+		release()
+		unlock()
+		releaseSessionMutex(dirPath)
+	}, nil
+}
+
+func lockDir(dirPath string, how int) (func(), error) {
+	dir, openErr := os.Open(dirPath)
+	if openErr != nil {
+		return nil, openErr
+	}
+	if lockErr := flock(dir.Fd(), how); lockErr != nil {
+		_ = dir.Close()
+		return nil, lockErr
+	}
+	return func() {
+		if unlockErr := flock(dir.Fd(), syscall.LOCK_UN); unlockErr != nil {
+			logError(unlockErr, "Unable to unlock '%s'", dirPath)
+		}
+		if closeErr := dir.Close(); closeErr != nil {
+			logError(closeErr, "Unable to close '%s'", dirPath)
+		}
+	}, nil
+}
+
+func addWriter() bool {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	if draining {
+		return false
+	}
+	writers++
+	return true
+}
+
+func removeWriter() {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	writers--
+	if writers == 0 {
+		writersIdle.Broadcast()
+	}
+}
+
+func waitWriters() {
+	writersLock.Lock()
+	defer writersLock.Unlock()
+	draining = true
+	if writers > 0 {
+		logInfo("Waiting for %d change(s) of the branches to finish", writers)
+	}
+	for writers > 0 {
+		writersIdle.Wait()
+	}
+}
@@ -16,27 +16,59 @@ package main
 */
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
-var debugMode bool
+type logRecord struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+	Error string    `json:"error,omitempty"`
+}
+
+func writeLog(level, msg string, err error) {
+	if serverCfg().LogFormat == logJson {
+		record := logRecord{Time: time.Now().UTC(), Level: strings.ToLower(level), Msg: msg}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		var line bytes.Buffer
+		encoder := json.NewEncoder(&line)
+		encoder.SetEscapeHTML(false)
+		if jsonErr := encoder.Encode(&record); jsonErr == nil {
+			_, _ = os.Stderr.Write(line.Bytes())
+			return
+		}
+	}
+	if err == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s.\n", level, msg)
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s: %s.\n", level, msg, err)
+	}
+}
 
 func logDebug(format string, args ...any) {
-	if debugMode {
-		_, _ = fmt.Fprintf(os.Stderr, "DEBUG: "+format+".\n", args...)
+	if serverCfg().Debug {
+		writeLog("DEBUG", fmt.Sprintf(format, args...), nil)
 	}
 }
 
 func logInfo(format string, args ...any) {
-	_, _ = fmt.Fprintf(os.Stderr, "INFO: "+format+".\n", args...)
+	writeLog("INFO", fmt.Sprintf(format, args...), nil)
 }
 
 func logError(err error, format string, args ...any) {
-	msg := fmt.Sprintf("ERROR: "+format, args...)
-	if err == nil {
-		_, _ = fmt.Fprintf(os.Stderr, "%s.\n", msg)
-	} else {
-		_, _ = fmt.Fprintf(os.Stderr, "%s: %s.\n", msg, err)
-	}
+	writeLog("ERROR", fmt.Sprintf(format, args...), err)
+}
+
+type serverLogWriter struct{}
+
+func (serverLogWriter) Write(p []byte) (int, error) {
+	logInfo("%s", strings.TrimSpace(string(p)))
+	return len(p), nil
 }
@@ -35,22 +35,104 @@ func main() {
 		SilenceUsage:      true,
 		CompletionOptions: cobra.CompletionOptions{HiddenDefaultCmd: true},
 	}
+	rootCmd.PersistentFlags().StringVar(
+		&outputFormat,
+		"output", outputFormat,
+		"Output format of the listings: text or json.",
+	)
 
 	var serverCmd = &cobra.Command{
-		Use:   "server <dir>",
+		Use:   "server [dir]",
 		Short: "Lunch the repository management server.",
-		Args:  cobra.ExactArgs(1),
-		RunE:  func(cmd *cobra.Command, args []string) error { return runServer(args[0]) },
+		Long: "Lunch the repository management server. The settings are taken from the flags,\n" +
+			"the configuration file overrides them and is read again on SIGHUP.",
+		Args: cobra.RangeArgs(0, 1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 1 {
+				serverDefaults.Root = args[0]
+			}
+			return runServer()
+		},
 	}
+	serverCmd.Flags().StringVarP(
+		&serverConfigPath,
+		"config", "c", "",
+		"Path to the server configuration file.",
+	)
 	serverCmd.Flags().BoolVarP(
-		&debugMode,
+		&serverDefaults.Debug,
 		"debug", "d", false,
 		"Enable debug mode.",
 	)
+	serverCmd.Flags().StringVar(
+		&serverDefaults.LogFormat,
+		"log-format", serverDefaults.LogFormat,
+		"Format of the log: text or json.",
+	)
+	serverCmd.Flags().StringSliceVarP(
+		&serverDefaults.Listen,
+		"listen", "l", serverDefaults.Listen,
+		"Addresses to listen on.",
+	)
+	serverCmd.Flags().StringSliceVarP(
+		&serverDefaults.Archs,
+		"arch", "a", serverDefaults.Archs,
+		"Architectures of the repository, the first one is the default.",
+	)
 	serverCmd.Flags().StringVarP(
-		&listenOn,
-		"listen", "l", listenOn,
-		"Address to listen on.",
+		&serverDefaults.TokensFile,
+		"tokens", "t", "",
+		"Path to the file with access tokens.",
+	)
+	serverCmd.Flags().StringVarP(
+		&serverDefaults.PoliciesFile,
+		"policies", "p", "",
+		"Path to the file with branch policies.",
+	)
+	serverCmd.Flags().IntVar(
+		&serverDefaults.Retention,
+		"retention", serverDefaults.Retention,
+		"Number of previous versions of every package to keep.",
+	)
+	serverCmd.Flags().DurationVar(
+		&serverDefaults.TrashKeep,
+		"trash-keep", serverDefaults.TrashKeep,
+		"How long removed branches are kept in the trash, zero keeps them forever.",
+	)
+	serverCmd.Flags().DurationVar(
+		&serverDefaults.UploadKeep,
+		"upload-keep", serverDefaults.UploadKeep,
+		"How long unfinished chunked uploads are kept since their last chunk.",
+	)
+	serverCmd.Flags().DurationVar(
+		&serverDefaults.DrainTimeout,
+		"drain-timeout", serverDefaults.DrainTimeout,
+		"How long the requests in progress are waited for on shutdown, zero waits for them without limit.",
+	)
+	serverCmd.Flags().StringVar(
+		&serverDefaults.SignKey,
+		"sign-key", "",
+		"Path to the OpenPGP private key to sign the databases with.",
+	)
+	serverCmd.Flags().BoolVar(
+		&serverDefaults.SignPackages,
+		"sign-packages", false,
+		"Sign the packages which have no signature too.",
+	)
+	serverCmd.Flags().StringVar(
+		&serverDefaults.Keyring,
+		"keyring", "",
+		"Path to the OpenPGP public keys of the trusted packagers.",
+	)
+	serverCmd.Flags().StringVar(
+		&serverDefaults.AuditLog,
+		"audit-log", "",
+		"Path to the audit log, '.audit.jsonl' in the packages root by default.",
+	)
+	serverCmd.Flags().StringVar(
+		&serverDefaults.RepoAdd,
+		"repo-add", "",
+		"Generate databases with the given repo-add instead of the native generator.",
 	)
 
 	var branchesCmd = &cobra.Command{
@@ -70,9 +152,44 @@ func main() {
 		PreRunE: initSettings,
 		RunE:    func(cmd *cobra.Command, args []string) error { return createBranch(args[0]) },
 	}
+	var forceRemove bool
+	var removeBranchCmd = &cobra.Command{
+		Use:     "rm <name>",
+		Short:   "Move the branch to the trash on the server.",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: initSettings,
+		RunE:    func(cmd *cobra.Command, args []string) error { return removeBranch(args[0], forceRemove) },
+	}
+	removeBranchCmd.Flags().BoolVarP(
+		&forceRemove,
+		"force", "f", false,
+		"Do not ask for confirmation.",
+	)
+	var restoreBranchCmd = &cobra.Command{
+		Use:     "restore <name>",
+		Short:   "Restore the branch from the trash, the name is a trash entry or a branch.",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: initSettings,
+		RunE:    func(cmd *cobra.Command, args []string) error { return restoreBranch(args[0]) },
+	}
+	var trashCmd = &cobra.Command{
+		Use:   "trash",
+		Short: "Manage removed branches.",
+	}
+	var listTrashCmd = &cobra.Command{
+		Use:     "ls",
+		Short:   "List removed branches.",
+		PreRunE: initSettings,
+		RunE:    func(cmd *cobra.Command, args []string) error { return listTrash() },
+	}
+	trashCmd.AddCommand(listTrashCmd)
 	branchesCmd.AddCommand(listBranchesCmd)
 	branchesCmd.AddCommand(createBranchCmd)
+	branchesCmd.AddCommand(removeBranchCmd)
+	branchesCmd.AddCommand(restoreBranchCmd)
+	branchesCmd.AddCommand(trashCmd)
 
+	var pkgArch string
 	var pkgsCommands = &cobra.Command{
 		Use:   "pkgs",
 		Short: "Manage packages in the branch.",
@@ -82,14 +199,61 @@ func main() {
 		Short:   "List packages in the branch.",
 		Args:    cobra.ExactArgs(1),
 		PreRunE: initSettings,
-		RunE:    func(cmd *cobra.Command, args []string) error { return listPackages(args[0]) },
+		RunE:    func(cmd *cobra.Command, args []string) error { return listPackages(args[0], pkgArch) },
 	}
+	var getAll bool
+	var getDir string
+	var getJobs int
 	var getPkgCmd = &cobra.Command{
-		Use:     "get <branch> <name> [names...]",
-		Short:   "Get package(s) from the branch.",
+		Use:     "get <branch> [names...]",
+		Short:   "Get package(s) from the branch by pkgname or file name.",
+		Args:    cobra.MinimumNArgs(1),
+		PreRunE: initSettings,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getPackages(args[0], args[1:], getAll, pkgArch, getDir, getJobs)
+		},
+	}
+	getPkgCmd.Flags().BoolVar(
+		&getAll,
+		"all", false,
+		"Get all the packages of the branch.",
+	)
+	getPkgCmd.Flags().StringVarP(
+		&getDir,
+		"output-dir", "o", ".",
+		"Directory to put the packages to.",
+	)
+	getPkgCmd.Flags().IntVarP(
+		&getJobs,
+		"jobs", "j", 4,
+		"Number of parallel downloads.",
+	)
+	var infoPkgCmd = &cobra.Command{
+		Use:     "info <branch> <name>",
+		Short:   "Show information about the package in the branch.",
 		Args:    cobra.ExactArgs(2),
 		PreRunE: initSettings,
-		RunE:    func(cmd *cobra.Command, args []string) error { return getPackage(args[0], args[1]) },
+		RunE:    func(cmd *cobra.Command, args []string) error { return showPackage(args[0], args[1], pkgArch) },
+	}
+	for _, cmd := range []*cobra.Command{listPkgsCmd, getPkgCmd, infoPkgCmd} {
+		cmd.Flags().StringVarP(
+			&pkgArch,
+			"arch", "a", "",
+			"Architecture of the packages, all of them by default.",
+		)
+	}
+	var rollbackPkgCmd = &cobra.Command{
+		Use:     "rollback <branch> <pkgname> [version]",
+		Short:   "Restore the previous or the given version of the package in the branch.",
+		Args:    cobra.RangeArgs(2, 3),
+		PreRunE: initSettings,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			version := ""
+			if len(args) == 3 {
+				version = args[2]
+			}
+			return rollbackPackage(args[0], args[1], version)
+		},
 	}
 	var putPkgCmd = &cobra.Command{
 		Use:     "put <branch> <name> [names...]",
@@ -105,14 +269,73 @@ func main() {
 		PreRunE: initSettings,
 		RunE:    func(cmd *cobra.Command, args []string) error { return rmPackages(args[0], args[1:]) },
 	}
+	var movePkgs bool
+	var promotePkgCmd = &cobra.Command{
+		Use:     "promote <from> <to> <pkgname> [pkgnames...]",
+		Short:   "Copy package(s) from one branch to another.",
+		Args:    cobra.MinimumNArgs(3),
+		PreRunE: initSettings,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return promotePackages(args[0], args[1], args[2:], movePkgs)
+		},
+	}
+	promotePkgCmd.Flags().BoolVarP(
+		&movePkgs,
+		"move", "m", false,
+		"Remove the package(s) from the source branch.",
+	)
 	pkgsCommands.AddCommand(listPkgsCmd)
 	pkgsCommands.AddCommand(getPkgCmd)
+	pkgsCommands.AddCommand(infoPkgCmd)
 	pkgsCommands.AddCommand(putPkgCmd)
 	pkgsCommands.AddCommand(rmPkgCmd)
+	pkgsCommands.AddCommand(rollbackPkgCmd)
+	pkgsCommands.AddCommand(promotePkgCmd)
+
+	var syncKeep bool
+	var syncJobs int
+	var syncCmd = &cobra.Command{
+		Use:     "sync <branch> <dir>",
+		Short:   "Mirror the branch into the local directory, downloading only what changed.",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: initSettings,
+		RunE:    func(cmd *cobra.Command, args []string) error { return syncBranch(args[0], args[1], syncKeep, syncJobs) },
+	}
+	syncCmd.Flags().BoolVar(
+		&syncKeep,
+		"keep", false,
+		"Keep the packages removed from the branch.",
+	)
+	syncCmd.Flags().IntVarP(
+		&syncJobs,
+		"jobs", "j", 4,
+		"Number of parallel downloads.",
+	)
+
+	var auditOf, auditSince string
+	var auditCmd = &cobra.Command{
+		Use:     "audit",
+		Short:   "Show who changed the branches and how.",
+		Args:    cobra.NoArgs,
+		PreRunE: initSettings,
+		RunE:    func(cmd *cobra.Command, args []string) error { return showAudit(auditOf, auditSince) },
+	}
+	auditCmd.Flags().StringVarP(
+		&auditOf,
+		"branch", "b", "",
+		"Show only the changes of the branch, including the promotions from it.",
+	)
+	auditCmd.Flags().StringVarP(
+		&auditSince,
+		"since", "s", "",
+		"Show only the changes since the time (2006-01-02, 2006-01-02 15:04:05 in UTC or RFC 3339) or for the duration (24h).",
+	)
 
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(branchesCmd)
 	rootCmd.AddCommand(pkgsCommands)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(auditCmd)
 
 	if execErr := rootCmd.Execute(); execErr != nil {
 		logError(execErr, "Failed to execute command")
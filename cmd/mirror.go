@@ -0,0 +1,203 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+func fetchBranchArchs(branch string) ([]string, error) {
+	var summaries []branchSummary
+	listErr := newRequest().
+		Path("branches").
+		Accept(echo.MIMEApplicationJSON).ToJSON(&summaries).Fetch(context.Background())
+	if listErr != nil {
+		return nil, listErr
+	}
+	for _, summary := range summaries {
+		if summary.Name == branch {
+			if len(summary.Archs) == 0 {
+				return nil, fmt.Errorf("the server does not tell the architectures of '%s'", branch)
+			}
+			return summary.Archs, nil
+		}
+	}
+	return nil, fmt.Errorf("no branch '%s' on the server", branch)
+}
+
+func rmMirrored(path string) error {
+	if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
+		return rmErr
+	}
+	return nil
+}
+
+func fetchRepoFile(branch, arch, name, path string) (bool, error) {
+	request := newRequest().Pathf("repo/%s/%s/%s", branch, arch, name)
+	if stat, statErr := os.Lstat(path); statErr == nil && stat.Mode().IsRegular() {
+		request.Header("If-None-Match", repoETag(stat.ModTime(), stat.Size()))
+	}
+	transferred := false
+	fetchErr := request.
+		CheckStatus(http.StatusOK, http.StatusNotModified, http.StatusNotFound).
+		Handle(func(res *http.Response) error {
+			switch res.StatusCode {
+			case http.StatusNotModified:
+				return nil
+			case http.StatusNotFound:
+				return rmMirrored(path)
+			}
+			tmpPath := path + ".part"
+			fp, createErr := os.Create(tmpPath)
+			if createErr != nil {
+				return createErr
+			}
+			_, copyErr := io.Copy(fp, res.Body)
+			if closeErr := fp.Close(); copyErr == nil {
+				copyErr = closeErr
+			}
+			if modified, found := parseRepoETag(res.Header.Get("ETag")); copyErr == nil && found {
+				copyErr = os.Chtimes(tmpPath, modified, modified)
+			}
+			if copyErr == nil {
+				copyErr = rmMirrored(path)
+			}
+			if copyErr != nil {
+				_ = os.Remove(tmpPath)
+				return copyErr
+			}
+			transferred = true
+			return os.Rename(tmpPath, path)
+		}).
+		Fetch(context.Background())
+	return transferred, fetchErr
+}
+
+func syncDatabases(branch, arch, dirPath string) (int, error) {
+	count := 0
+	for _, kind := range []string{"db", "files"} {
+		for _, suffix := range []string{"", sigExt} {
+			archive := fmt.Sprintf("%s.%s.tar.gz%s", branch, kind, suffix)
+			transferred, fetchErr := fetchRepoFile(branch, arch, archive, filepath.Join(dirPath, archive))
+			if fetchErr != nil {
+				return count, fetchErr
+			}
+			if transferred {
+				count++
+			}
+			link := filepath.Join(dirPath, fmt.Sprintf("%s.%s%s", branch, kind, suffix))
+			if _, statErr := os.Stat(filepath.Join(dirPath, archive)); statErr != nil {
+				if rmErr := rmMirrored(link); rmErr != nil {
+					return count, rmErr
+				}
+				continue
+			}
+			if linkErr := publishSymlink(archive, link); linkErr != nil {
+				return count, linkErr
+			}
+		}
+	}
+	return count, nil
+}
+
+func pruneMirror(dirPath string, summaries []pkgSummary) (int, error) {
+	current := make(map[string]bool)
+	for _, summary := range summaries {
+		current[summary.Filename] = true
+	}
+	paths, globErr := globPkgs(dirPath)
+	if globErr != nil {
+		return 0, globErr
+	}
+	count := 0
+	for _, path := range paths {
+		if current[filepath.Base(path)] {
+			continue
+		}
+		for _, name := range []string{path, path + sigExt} {
+			if rmErr := rmMirrored(name); rmErr != nil {
+				return count, rmErr
+			}
+		}
+		fmt.Printf("Removed '%s'.\n", path)
+		count++
+	}
+	return count, nil
+}
+
+func syncBranch(branch, dirPath string, keep bool, jobs int) error {
+	archs, archsErr := fetchBranchArchs(branch)
+	if archsErr != nil {
+		return archsErr
+	}
+	started := time.Now()
+	var downloaded, removed, databases int
+	for _, arch := range archs {
+		archDir := filepath.Join(dirPath, arch)
+		if mkErr := os.MkdirAll(archDir, 0755); mkErr != nil {
+			return mkErr
+		}
+		summaries, listErr := fetchSummaries(branch, arch)
+		if listErr != nil {
+			return listErr
+		}
+		var mutex sync.Mutex
+		var fetched []pkgSummary
+		downloadErr := downloadPackages(branch, summaries, arch, archDir, jobs, func(summary pkgSummary) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			fetched = append(fetched, summary)
+		})
+		if downloadErr != nil {
+			return downloadErr
+		}
+		downloaded += len(fetched)
+		for _, summary := range summaries {
+			sigPath := filepath.Join(archDir, summary.Filename+sigExt)
+			isFetched := slices.ContainsFunc(fetched, func(other pkgSummary) bool { return other.Filename == summary.Filename })
+			if _, statErr := os.Lstat(sigPath); !isFetched && (statErr == nil || !summary.Signed) {
+				continue
+			}
+			if _, sigErr := fetchRepoFile(branch, arch, summary.Filename+sigExt, sigPath); sigErr != nil {
+				return sigErr
+			}
+		}
+		if !keep {
+			count, pruneErr := pruneMirror(archDir, summaries)
+			if pruneErr != nil {
+				return pruneErr
+			}
+			removed += count
+		}
+		count, dbErr := syncDatabases(branch, arch, archDir)
+		if dbErr != nil {
+			return dbErr
+		}
+		databases += count
+	}
+	fmt.Printf("Synced '%s' in %s: %d package(s) downloaded, %d removed, %d database file(s) updated.\n",
+		branch, time.Since(started).Round(time.Millisecond), downloaded, removed, databases)
+	return nil
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/labstack/echo/v4"
 	"io"
 	"os"
 	"os/exec"
@@ -24,6 +25,10 @@ import (
 	"strings"
 )
 
+func wantsJson(c echo.Context) bool {
+	return strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON)
+}
+
 func rmFile(path string) {
 	logInfo("Removing '%s'", path)
 	if rmErr := os.Remove(path); rmErr != nil && !os.IsNotExist(rmErr) {
@@ -50,25 +55,28 @@ func saveFile(path string, reader io.ReadCloser) error {
 	return fp.Sync()
 }
 
-func rebuildDatabase(dirPath, branch string) error {
-	dbPaths, dbGlobErr := filepath.Glob(filepath.Join(dirPath, fmt.Sprintf("%s.*", branch)))
-	if dbGlobErr != nil {
-		return dbGlobErr
-	}
-	pkgPaths, pkgGlobErr := filepath.Glob(filepath.Join(dirPath, pkgWildcard))
-	if pkgGlobErr != nil {
-		return pkgGlobErr
+func publishFile(srcPath, dstPath string) error {
+	logDebug("Publishing '%s'=>'%s'", srcPath, dstPath)
+	return os.Rename(srcPath, dstPath)
+}
+
+func publishSymlink(target, linkPath string) error {
+	tmpPath := filepath.Join(filepath.Dir(linkPath), "."+filepath.Base(linkPath)+".tmp")
+	_ = os.Remove(tmpPath)
+	if linkErr := os.Symlink(target, tmpPath); linkErr != nil {
+		return linkErr
 	}
-	args := []string{filepath.Join(dirPath, fmt.Sprintf("%s.db.tar.gz", branch))}
-	args = append(args, pkgPaths...)
-	for _, path := range dbPaths {
-		rmFile(path)
-	}
-	if len(pkgPaths) == 0 {
-		return nil
+	if renameErr := os.Rename(tmpPath, linkPath); renameErr != nil {
+		rmFile(tmpPath)
+		return renameErr
 	}
+	return nil
+}
+
+func runRepoAdd(dbPath string, pkgPaths []string) error {
+	args := append([]string{dbPath}, pkgPaths...)
 	sargs := strings.Join(args, " ")
-	cmd := exec.Command("repo-add", args...)
+	cmd := exec.Command(serverCfg().RepoAdd, args...)
 	stdout, execErr := cmd.CombinedOutput()
 	lines := strings.ReplaceAll(string(stdout), "\n", "\\n")
 	if execErr != nil {
@@ -78,3 +86,90 @@ func rebuildDatabase(dirPath, branch string) error {
 	}
 	return execErr
 }
+
+func generateDatabases(stagingDir, dirPath, branch string, pkgPaths []string) error {
+	dbPath := filepath.Join(stagingDir, fmt.Sprintf("%s.db.tar.gz", branch))
+	if serverCfg().RepoAdd != "" {
+		return runRepoAdd(dbPath, pkgPaths)
+	}
+	var entries []*pkgEntry
+	for _, path := range pkgPaths {
+		entry, entryErr := loadPkgEntry(path)
+		if entryErr != nil {
+			return entryErr
+		}
+		entry.PgpSig = readPgpSig(path)
+		entries = append(entries, entry)
+	}
+	pruneCache(dirPath)
+	if dbErr := writeDatabase(dbPath, entries, false); dbErr != nil {
+		return dbErr
+	}
+	return writeDatabase(filepath.Join(stagingDir, fmt.Sprintf("%s.files.tar.gz", branch)), entries, true)
+}
+
+func rebuildDatabase(dirPath, branch string) error {
+	cfg := serverCfg()
+	pkgPaths, pkgGlobErr := globPkgs(dirPath)
+	if pkgGlobErr != nil {
+		return pkgGlobErr
+	}
+	if len(pkgPaths) == 0 && cfg.RepoAdd != "" {
+		dbPaths, dbGlobErr := filepath.Glob(filepath.Join(dirPath, fmt.Sprintf("%s.*", branch)))
+		if dbGlobErr != nil {
+			return dbGlobErr
+		}
+		for _, path := range dbPaths {
+			rmFile(path)
+		}
+		return nil
+	}
+	if signErr := signMissing(pkgPaths, cfg); signErr != nil {
+		return signErr
+	}
+	stagingDir, tmpErr := os.MkdirTemp(dirPath, ".staging-")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	defer func() {
+		if rmErr := os.RemoveAll(stagingDir); rmErr != nil {
+			logError(rmErr, "Unable to remove '%s'", stagingDir)
+		}
+	}()
+	if genErr := generateDatabases(stagingDir, dirPath, branch, pkgPaths); genErr != nil {
+		return genErr
+	}
+	files := []string{""}
+	if cfg.signingKey != nil {
+		files = append(files, sigExt)
+		for _, kind := range []string{"db", "files"} {
+			if signErr := signFile(filepath.Join(stagingDir, fmt.Sprintf("%s.%s.tar.gz", branch, kind)), cfg.signingKey); signErr != nil {
+				return signErr
+			}
+		}
+	}
+	for _, kind := range []string{"db", "files"} {
+		for _, suffix := range files {
+			archive := fmt.Sprintf("%s.%s.tar.gz%s", branch, kind, suffix)
+			if publishErr := publishFile(filepath.Join(stagingDir, archive), filepath.Join(dirPath, archive)); publishErr != nil {
+				return publishErr
+			}
+		}
+	}
+	for _, kind := range []string{"db", "files"} {
+		for _, suffix := range files {
+			link := fmt.Sprintf("%s.%s%s", branch, kind, suffix)
+			if linkErr := publishSymlink(fmt.Sprintf("%s.%s.tar.gz%s", branch, kind, suffix), filepath.Join(dirPath, link)); linkErr != nil {
+				return linkErr
+			}
+		}
+		if cfg.signingKey == nil {
+			for _, name := range []string{fmt.Sprintf("%s.%s%s", branch, kind, sigExt), fmt.Sprintf("%s.%s.tar.gz%s", branch, kind, sigExt)} {
+				if _, statErr := os.Lstat(filepath.Join(dirPath, name)); statErr == nil {
+					rmFile(filepath.Join(dirPath, name))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cacheDirName = ".cache"
+	cacheFormat  = 2
+	maxInfoSize  = 1048576
+)
+
+type pkgInfo struct {
+	Name         string   `json:"name"`
+	Base         string   `json:"base,omitempty"`
+	Version      string   `json:"version"`
+	Epoch        string   `json:"epoch,omitempty"`
+	PkgVer       string   `json:"pkgver"`
+	PkgRel       string   `json:"pkgrel"`
+	Desc         string   `json:"desc,omitempty"`
+	Url          string   `json:"url,omitempty"`
+	Arch         string   `json:"arch"`
+	BuildDate    int64    `json:"builddate"`
+	Packager     string   `json:"packager,omitempty"`
+	Size         int64    `json:"size"`
+	Groups       []string `json:"groups,omitempty"`
+	Licenses     []string `json:"license,omitempty"`
+	Replaces     []string `json:"replaces,omitempty"`
+	Conflicts    []string `json:"conflicts,omitempty"`
+	Provides     []string `json:"provides,omitempty"`
+	Depends      []string `json:"depends,omitempty"`
+	OptDepends   []string `json:"optdepends,omitempty"`
+	MakeDepends  []string `json:"makedepends,omitempty"`
+	CheckDepends []string `json:"checkdepends,omitempty"`
+	Backup       []string `json:"backup,omitempty"`
+}
+
+type pkgEntry struct {
+	Format   int      `json:"format"`
+	Filename string   `json:"filename"`
+	FileSize int64    `json:"filesize"`
+	ModTime  int64    `json:"mtime"`
+	Md5      string   `json:"md5"`
+	Sha256   string   `json:"sha256"`
+	Info     pkgInfo  `json:"info"`
+	Files    []string `json:"files"`
+	PgpSig   string   `json:"-"`
+}
+
+func parsePkgInfo(content string) (*pkgInfo, error) {
+	var info pkgInfo
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "pkgname":
+			info.Name = value
+		case "pkgbase":
+			info.Base = value
+		case "pkgver":
+			info.Version = value
+		case "pkgdesc":
+			info.Desc = value
+		case "url":
+			info.Url = value
+		case "arch":
+			info.Arch = value
+		case "packager":
+			info.Packager = value
+		case "builddate":
+			info.BuildDate, _ = strconv.ParseInt(value, 10, 64)
+		case "size":
+			info.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "group":
+			info.Groups = append(info.Groups, value)
+		case "license":
+			info.Licenses = append(info.Licenses, value)
+		case "replaces":
+			info.Replaces = append(info.Replaces, value)
+		case "conflict":
+			info.Conflicts = append(info.Conflicts, value)
+		case "provides":
+			info.Provides = append(info.Provides, value)
+		case "depend":
+			info.Depends = append(info.Depends, value)
+		case "optdepend":
+			info.OptDepends = append(info.OptDepends, value)
+		case "makedepend":
+			info.MakeDepends = append(info.MakeDepends, value)
+		case "checkdepend":
+			info.CheckDepends = append(info.CheckDepends, value)
+		case "backup":
+			info.Backup = append(info.Backup, value)
+		}
+	}
+	if info.Name == "" {
+		return nil, fmt.Errorf("no pkgname")
+	}
+	if info.Version == "" {
+		return nil, fmt.Errorf("no pkgver")
+	}
+	version := info.Version
+	if epoch, rest, found := strings.Cut(version, ":"); found {
+		info.Epoch, version = epoch, rest
+	}
+	if sep := strings.LastIndex(version, "-"); sep > 0 {
+		info.PkgVer, info.PkgRel = version[:sep], version[sep+1:]
+	} else {
+		return nil, fmt.Errorf("no pkgrel in version '%s'", info.Version)
+	}
+	return &info, nil
+}
+
+func readInfoFile(pkgTar *tar.Reader, path string) (*pkgInfo, error) {
+	content, readErr := io.ReadAll(io.LimitReader(pkgTar, maxInfoSize+1))
+	if readErr != nil {
+		return nil, fmt.Errorf("unable to read info file in '%s': %s", path, readErr)
+	}
+	if len(content) > maxInfoSize {
+		return nil, fmt.Errorf("info file in '%s' is larger than %d bytes", path, maxInfoSize)
+	}
+	info, parseErr := parsePkgInfo(string(content))
+	if parseErr != nil {
+		return nil, fmt.Errorf("invalid info file in '%s': %s", path, parseErr)
+	}
+	return info, nil
+}
+
+func scanPackage(path string) (*pkgEntry, error) {
+	pkgFile, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer func() {
+		if closeErr := pkgFile.Close(); closeErr != nil {
+			logError(closeErr, "Unable to close pkg file '%s'", path)
+		}
+	}()
+	stat, statErr := pkgFile.Stat()
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	rawReader := io.TeeReader(bufio.NewReaderSize(pkgFile, fileChunkSize), io.MultiWriter(md5Hash, sha256Hash))
+	reader, decompressErr := decompress(bufio.NewReader(rawReader))
+	if decompressErr != nil {
+		return nil, fmt.Errorf("unable to decompress '%s': %s", path, decompressErr)
+	}
+	defer func() {
+		if closeErr := reader.Close(); closeErr != nil {
+			logError(closeErr, "Unable to close decompressor of '%s'", path)
+		}
+	}()
+
+	entry := pkgEntry{Format: cacheFormat, Filename: filepath.Base(path), FileSize: stat.Size(), ModTime: stat.ModTime().UnixNano()}
+	var info *pkgInfo
+	pkgTar := tar.NewReader(reader)
+	for {
+		header, tarErr := pkgTar.Next()
+		if tarErr != nil {
+			if tarErr == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("invalid TAR in '%s': %s", path, tarErr)
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == ".PKGINFO" {
+			var infoErr error
+			if info, infoErr = readInfoFile(pkgTar, path); infoErr != nil {
+				return nil, infoErr
+			}
+			continue
+		}
+		if name == "" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if header.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		entry.Files = append(entry.Files, name)
+	}
+	if info == nil {
+		return nil, fmt.Errorf("no info file in '%s'", path)
+	}
+	if _, drainErr := io.Copy(io.Discard, reader); drainErr != nil {
+		return nil, fmt.Errorf("invalid compressed stream in '%s': %s", path, drainErr)
+	}
+	if _, drainErr := io.Copy(io.Discard, rawReader); drainErr != nil {
+		return nil, drainErr
+	}
+	entry.Info = *info
+	entry.Md5 = hex.EncodeToString(md5Hash.Sum(nil))
+	entry.Sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	return &entry, nil
+}
+
+func cachePath(path string) string {
+	return filepath.Join(filepath.Dir(path), cacheDirName, filepath.Base(path)+".json")
+}
+
+func saveCachedEntry(path string, entry *pkgEntry) error {
+	if mkErr := os.MkdirAll(filepath.Dir(cachePath(path)), 0755); mkErr != nil {
+		return mkErr
+	}
+	content, encodeErr := json.Marshal(entry)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	fp, tmpErr := os.CreateTemp(filepath.Dir(cachePath(path)), ".tmp-")
+	if tmpErr != nil {
+		return tmpErr
+	}
+	_, writeErr := fp.Write(content)
+	if closeErr := fp.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Chmod(fp.Name(), 0644)
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(fp.Name(), cachePath(path))
+	}
+	if writeErr != nil {
+		_ = os.Remove(fp.Name())
+	}
+	return writeErr
+}
+
+func loadPkgEntry(path string) (*pkgEntry, error) {
+	stat, statErr := os.Stat(path)
+	if statErr != nil {
+		return nil, statErr
+	}
+	if content, readErr := os.ReadFile(cachePath(path)); readErr == nil {
+		var entry pkgEntry
+		if json.Unmarshal(content, &entry) == nil &&
+			entry.Format == cacheFormat &&
+			entry.Filename == filepath.Base(path) &&
+			entry.FileSize == stat.Size() &&
+			entry.ModTime == stat.ModTime().UnixNano() {
+			return &entry, nil
+		}
+	}
+	logDebug("Scanning '%s'", path)
+	entry, scanErr := scanPackage(path)
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if saveErr := saveCachedEntry(path, entry); saveErr != nil {
+		logError(saveErr, "Unable to cache metadata of '%s'", path)
+	}
+	return entry, nil
+}
+
+func pruneCache(dirPath string) {
+	paths, globErr := filepath.Glob(filepath.Join(dirPath, cacheDirName, "*"))
+	if globErr != nil {
+		logError(globErr, "Unable to glob cache in '%s'", dirPath)
+		return
+	}
+	for _, path := range paths {
+		pkgPath := filepath.Join(dirPath, strings.TrimSuffix(filepath.Base(path), ".json"))
+		if _, statErr := os.Stat(pkgPath); os.IsNotExist(statErr) {
+			rmFile(path)
+		}
+	}
+}
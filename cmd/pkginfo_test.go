@@ -0,0 +1,49 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanPackageRejectsHugeInfoFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foo-1.0-1-x86_64.pkg.tar")
+	fp, createErr := os.Create(path)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	content := "pkgname = foo\npkgver = 1.0-1\narch = x86_64\n" + strings.Repeat("# padding\n", maxInfoSize/10+1)
+	pkgTar := tar.NewWriter(fp)
+	if writeErr := pkgTar.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0644, Size: int64(len(content))}); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, writeErr := pkgTar.Write([]byte(content)); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if closeErr := pkgTar.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if closeErr := fp.Close(); closeErr != nil {
+		t.Fatal(closeErr)
+	}
+	if _, scanErr := scanPackage(path); scanErr == nil || !strings.Contains(scanErr.Error(), "larger than") {
+		t.Errorf("scanPackage accepted an info file of %d bytes: %v", len(content), scanErr)
+	}
+}
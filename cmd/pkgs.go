@@ -16,30 +16,105 @@ package main
 */
 
 import (
+	"fmt"
 	"github.com/labstack/echo/v4"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const checksumHeader = "X-Package-Sha256"
+
+type pkgSummary struct {
+	Name     string    `json:"name"`
+	Version  string    `json:"version"`
+	Arch     string    `json:"arch"`
+	Filename string    `json:"filename"`
+	Size     int64     `json:"size"`
+	Sha256   string    `json:"sha256"`
+	Uploaded time.Time `json:"uploaded"`
+	Signed   bool      `json:"signed"`
+}
+
+func summarizePkg(dirPath string, entry *pkgEntry) *pkgSummary {
+	_, sigErr := os.Stat(filepath.Join(dirPath, entry.Filename+sigExt))
+	return &pkgSummary{
+		Name:     entry.Info.Name,
+		Version:  entry.Info.Version,
+		Arch:     entry.Info.Arch,
+		Filename: entry.Filename,
+		Size:     entry.FileSize,
+		Sha256:   entry.Sha256,
+		Uploaded: time.Unix(0, entry.ModTime).UTC(),
+		Signed:   sigErr == nil,
+	}
+}
+
 func lsPkgsHandler(rootDir string, c echo.Context) error {
 	branch := c.Param("branch")
 	if branch == "" {
 		return c.NoContent(http.StatusNotFound)
 	}
+	arch, archOk := archParam(c)
+	if !archOk {
+		return rejectRequest(c, "architecture", arch)
+	}
+	branchDir := filepath.Join(rootDir, branch)
 	if name := c.QueryParam("name"); name != "" {
-		return c.File(filepath.Join(rootDir, branch, name))
+		if !validPkgFile(name) {
+			return rejectRequest(c, "package file", name)
+		}
+		for _, dirPath := range archDirs(branchDir, arch) {
+			if _, statErr := os.Stat(filepath.Join(dirPath, name)); statErr == nil {
+				return c.File(filepath.Join(dirPath, name))
+			}
+		}
+		return c.NoContent(http.StatusNotFound)
 	}
-	paths, globErr := filepath.Glob(filepath.Join(rootDir, branch, pkgWildcard))
-	if globErr != nil {
-		logError(globErr, "Unable to glob pkg in '%s/%s'", rootDir, branch)
+	unlock, lockErr := lockBranch(branchDir, false)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer unlock()
+	paths := make(map[string]string)
+	for _, dirPath := range archDirs(branchDir, arch) {
+		dirPaths, globErr := globPkgs(dirPath)
+		if globErr != nil {
+			logError(globErr, "Unable to glob pkg in '%s'", dirPath)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, path := range dirPaths {
+			if _, found := paths[filepath.Base(path)]; !found {
+				paths[filepath.Base(path)] = path
+			}
+		}
+	}
+	if wantsJson(c) {
+		summaries := []*pkgSummary{}
+		for _, path := range paths {
+			entry, entryErr := loadPkgEntry(path)
+			if entryErr != nil {
+				logError(entryErr, "Unable to load pkg info from '%s'", path)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			summaries = append(summaries, summarizePkg(filepath.Dir(path), entry))
+		}
+		sort.Slice(summaries, func(i, j int) bool { return summaries[i].Filename < summaries[j].Filename })
+		return c.JSON(http.StatusOK, summaries)
+	}
 	var names []string
-	for _, path := range paths {
-		names = append(names, filepath.Base(path))
+	for name := range paths {
+		names = append(names, name)
 	}
 	if len(names) == 0 {
 		return c.String(http.StatusOK, "No entries.")
@@ -48,50 +123,164 @@ func lsPkgsHandler(rootDir string, c echo.Context) error {
 	return c.String(http.StatusOK, strings.Join(names, "\n"))
 }
 
+type pendingPkg struct {
+	tmpPath string
+	entry   *pkgEntry
+	archs   []string
+}
+
+func receivePackage(branchDir, branch, name string, body io.ReadCloser, header http.Header) (*pendingPkg, int) {
+	checksum := header.Get(checksumHeader)
+	if !validSha256(checksum) {
+		logInfo("Rejected '%s' for '%s': invalid or missing checksum '%s'", name, branch, checksum)
+		return nil, http.StatusBadRequest
+	}
+	signature, sigErr := uploadedSignature(header, branch)
+	if sigErr != nil {
+		logError(sigErr, "Rejected '%s' for '%s'", name, branch)
+		return nil, http.StatusBadRequest
+	}
+	tmpPath, tmpErr := createTmpPkg(branchDir)
+	if tmpErr != nil {
+		logError(tmpErr, "Unable to create temporary file in '%s'", branchDir)
+		return nil, http.StatusInternalServerError
+	}
+	logInfo("Storing '%s'", tmpPath)
+	if saveErr := saveFile(tmpPath, body); saveErr != nil {
+		logError(saveErr, "Unable to save pkg to '%s'", tmpPath)
+		rmPackage(tmpPath)
+		return nil, http.StatusInternalServerError
+	}
+	return checkPackage(tmpPath, branch, name, checksum, signature)
+}
+
+func createTmpPkg(dirPath string) (string, error) {
+	fp, createErr := os.CreateTemp(dirPath, "tmp_*_pmt")
+	if createErr != nil {
+		return "", createErr
+	}
+	return fp.Name(), fp.Close()
+}
+
+func checkPackage(tmpPath, branch, name, checksum string, signature []byte) (*pendingPkg, int) {
+	newEntry, scanErr := scanPackage(tmpPath)
+	if scanErr != nil {
+		logError(scanErr, "Invalid pkg '%s'", tmpPath)
+		rmPackage(tmpPath)
+		return nil, http.StatusBadRequest
+	}
+	if !strings.EqualFold(checksum, newEntry.Sha256) {
+		logError(nil, "Checksum mismatch of '%s': expected %s, got %s", tmpPath, checksum, newEntry.Sha256)
+		rmPackage(tmpPath)
+		return nil, http.StatusBadRequest
+	}
+	newEntry.Filename = name
+	archs := targetArchs(newEntry.Info.Arch)
+	if len(archs) == 0 {
+		logInfo("Rejected '%s' for '%s': unknown architecture '%s'", name, branch, newEntry.Info.Arch)
+		rmPackage(tmpPath)
+		return nil, http.StatusBadRequest
+	}
+	if signature != nil {
+		if serverCfg().trustedKeys != nil || policyFor(branch).RequireSignature {
+			if verifyErr := verifySignature(tmpPath, signature); verifyErr != nil {
+				logError(verifyErr, "Bad signature of '%s'", tmpPath)
+				rmPackage(tmpPath)
+				return nil, http.StatusBadRequest
+			}
+		}
+		if writeErr := os.WriteFile(tmpPath+sigExt, signature, 0644); writeErr != nil {
+			logError(writeErr, "Unable to save signature of '%s'", tmpPath)
+			rmPackage(tmpPath)
+			return nil, http.StatusInternalServerError
+		}
+	}
+	return &pendingPkg{tmpPath: tmpPath, entry: newEntry, archs: archs}, 0
+}
+
+func installPending(branchDir string, pending []*pendingPkg) ([]string, func(), error) {
+	var dirs, stagedPaths []string
+	var reverts []func()
+	rollback := func() {
+		for i := len(reverts) - 1; i >= 0; i-- {
+			reverts[i]()
+		}
+		for _, path := range stagedPaths {
+			rmPackage(path)
+		}
+	}
+	for _, arch := range serverCfg().Archs {
+		dirPath := archPath(branchDir, arch)
+		installed := false
+		for _, pkg := range pending {
+			if !slices.Contains(pkg.archs, arch) {
+				continue
+			}
+			stagedPath, stageErr := stagePackage(pkg.tmpPath, dirPath, pkg.entry)
+			if stageErr != nil {
+				rollback()
+				return nil, nil, fmt.Errorf("unable to stage '%s' in '%s': %s", pkg.tmpPath, dirPath, stageErr)
+			}
+			stagedPaths = append(stagedPaths, stagedPath)
+			revert, installErr := installPackage(dirPath, stagedPath, pkg.entry.Filename, pkg.entry.Info.Name)
+			if installErr != nil {
+				rollback()
+				return nil, nil, fmt.Errorf("unable to install pkg from '%s' to '%s': %s", stagedPath, dirPath, installErr)
+			}
+			reverts = append(reverts, revert)
+			installed = true
+		}
+		if installed {
+			dirs = append(dirs, dirPath)
+		}
+	}
+	return dirs, rollback, nil
+}
+
 func addPkgHandler(rootDir string, c echo.Context) error {
 	branch := c.Param("branch")
 	if branch == "" {
 		return c.NoContent(http.StatusNotFound)
 	}
 	name := c.QueryParam("name")
-	if name == "" {
-		return c.NoContent(http.StatusBadRequest)
+	if !validPkgFile(name) {
+		return rejectRequest(c, "package file", name)
 	}
 	branchDir := filepath.Join(rootDir, branch)
-	pkgs, pkgsErr := loadPkgNames(branchDir)
-	if pkgsErr != nil {
-		logError(pkgsErr, "Unable to load pkg names from '%s'", branchDir)
-		return c.NoContent(http.StatusInternalServerError)
+	if _, statErr := os.Stat(branchDir); statErr != nil {
+		return c.NoContent(http.StatusNotFound)
 	}
-	tmpPath := filepath.Join(branchDir, "tmp_"+name+"_pmt")
-	logInfo("Storing '%s'", tmpPath)
-	if saveErr := saveFile(tmpPath, c.Request().Body); saveErr != nil {
-		logError(saveErr, "Unable to save pkg to '%s'", tmpPath)
+	pkg, status := receivePackage(branchDir, branch, name, c.Request().Body, c.Request().Header)
+	if pkg == nil {
+		return c.NoContent(status)
+	}
+	defer rmPackage(pkg.tmpPath)
+	unlock, lockErr := lockBranch(branchDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", branchDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	newName, pkgErr := getPkgName(tmpPath)
-	if pkgErr != nil {
-		logError(pkgErr, "Unable to load pkg name from '%s'", tmpPath)
-		defer rmFile(tmpPath)
+	defer unlock()
+
+	replaced := currentFiles(archDirs(branchDir, ""), pkg.entry.Info.Name)
+	dirs, rollback, installErr := installPending(branchDir, []*pendingPkg{pkg})
+	if installErr != nil {
+		logError(installErr, "Unable to install '%s' to '%s'", name, branch)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	for _, path := range pkgs[newName] {
-		rmFile(path)
+	if quotaErr := checkQuota(branchDir, branch); quotaErr != nil {
+		rollback()
+		return quotaResponse(c, quotaErr)
 	}
-	newPath := filepath.Join(branchDir, name)
-	logInfo("Moving '%s'=>'%s'", tmpPath, newPath)
-	if renameErr := os.Rename(tmpPath, newPath); renameErr != nil {
-		logError(renameErr, "Unable to rename pkg from '%s' to '%s'", tmpPath, newPath)
-		defer rmFile(tmpPath)
-		defer rmFile(newPath)
+	if rebuildErr := rebuildDatabases(dirs, branch, rollback); rebuildErr != nil {
+		logError(rebuildErr, "Unable to rebuild databases of '%s'", branchDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if rebuildErr := rebuildDatabase(branchDir, branch); rebuildErr != nil {
-		defer rmFile(newPath)
-		logError(rebuildErr, "Unable to rebuild database")
-		return c.NoContent(http.StatusInternalServerError)
+	for _, dirPath := range dirs {
+		pruneArchive(dirPath, branch, pkg.entry.Info.Name)
 	}
-	logInfo("Added '%s'", newPath)
+	logInfo("Added '%s' to '%s' for %s", name, branch, strings.Join(pkg.archs, ", "))
+	recordAudit(c, auditEntry{Action: auditPackageAdd, Branch: branch, Files: []auditFile{auditEntryFile(pkg.entry)}, Replaced: replaced})
 	return c.NoContent(http.StatusCreated)
 }
 
@@ -104,24 +293,158 @@ func rmPkgHandler(rootDir string, c echo.Context) error {
 	if names == "" {
 		return c.NoContent(http.StatusBadRequest)
 	}
+	for _, name := range strings.Split(names, ",") {
+		if !validPkgRef(name) {
+			return rejectRequest(c, "package", name)
+		}
+	}
 	branchDir := filepath.Join(rootDir, branch)
+	unlock, lockErr := lockBranch(branchDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	var removed []auditFile
+	for _, dirPath := range archDirs(branchDir, "") {
+		pkgs, pkgsErr := loadPkgNames(dirPath)
+		if pkgsErr != nil {
+			logError(pkgsErr, "Unable to load pkg names from '%s'", dirPath)
+			if len(removed) > 0 {
+				recordAudit(c, auditEntry{Action: auditPackageRemove, Branch: branch, Files: removed})
+			}
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, name := range strings.Split(names, ",") {
+			paths := pkgs[name]
+			if isPkgFile(name) {
+				if _, statErr := os.Stat(filepath.Join(dirPath, name)); statErr == nil {
+					paths = append(paths, filepath.Join(dirPath, name))
+				}
+			}
+			for _, path := range paths {
+				file := auditFile{Name: filepath.Base(path)}
+				if entry, entryErr := loadPkgEntry(path); entryErr == nil {
+					file.Sha256 = entry.Sha256
+				}
+				removed = appendAuditFile(removed, file)
+				rmPackage(path)
+			}
+		}
+	}
+	if len(removed) > 0 {
+		recordAudit(c, auditEntry{Action: auditPackageRemove, Branch: branch, Files: removed})
+	}
+	for _, dirPath := range archDirs(branchDir, "") {
+		if rebuildErr := rebuildDatabase(dirPath, branch); rebuildErr != nil {
+			logError(rebuildErr, "Unable to rebuild database of '%s'", dirPath)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func findPkgEntry(branchDir, name string) (*pkgEntry, error) {
+	if isPkgFile(name) {
+		return loadPkgEntry(filepath.Join(branchDir, name))
+	}
 	pkgs, pkgsErr := loadPkgNames(branchDir)
 	if pkgsErr != nil {
-		logError(pkgsErr, "Unable to load pkg names from '%s'", branchDir)
+		return nil, pkgsErr
+	}
+	paths := pkgs[name]
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+	sort.Strings(paths)
+	return loadPkgEntry(paths[len(paths)-1])
+}
+
+func formatPkgInfo(entry *pkgEntry) string {
+	info := &entry.Info
+	var lines []string
+	add := func(key string, values ...string) {
+		value := strings.Join(values, "  ")
+		if value == "" {
+			value = "None"
+		}
+		lines = append(lines, fmt.Sprintf("%-15s : %s", key, value))
+	}
+	add("Name", info.Name)
+	add("Base", info.Base)
+	add("Version", info.Version)
+	add("Epoch", info.Epoch)
+	add("Pkgver", info.PkgVer)
+	add("Pkgrel", info.PkgRel)
+	add("Description", info.Desc)
+	add("Architecture", info.Arch)
+	add("URL", info.Url)
+	add("Licenses", info.Licenses...)
+	add("Groups", info.Groups...)
+	add("Provides", info.Provides...)
+	add("Depends On", info.Depends...)
+	add("Optional Deps", info.OptDepends...)
+	add("Make Deps", info.MakeDepends...)
+	add("Check Deps", info.CheckDepends...)
+	add("Conflicts With", info.Conflicts...)
+	add("Replaces", info.Replaces...)
+	add("Backup Files", info.Backup...)
+	add("Download Size", strconv.FormatInt(entry.FileSize, 10))
+	add("Installed Size", strconv.FormatInt(info.Size, 10))
+	add("Packager", info.Packager)
+	add("Build Date", time.Unix(info.BuildDate, 0).UTC().Format(time.RFC1123))
+	add("File Name", entry.Filename)
+	add("SHA-256 Sum", entry.Sha256)
+	return strings.Join(lines, "\n")
+}
+
+func pkgInfoHandler(rootDir string, c echo.Context) error {
+	branch := c.Param("branch")
+	name := c.Param("name")
+	if branch == "" || name == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if !validPkgRef(name) {
+		return rejectRequest(c, "package", name)
+	}
+	arch, archOk := archParam(c)
+	if !archOk {
+		return rejectRequest(c, "architecture", arch)
+	}
+	branchDir := filepath.Join(rootDir, branch)
+	unlock, lockErr := lockBranch(branchDir, false)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	for _, name := range strings.Split(names, ",") {
-		paths := pkgs[name]
-		if strings.HasSuffix(name, pkgExt) {
-			paths = append(paths, filepath.Join(branchDir, name))
+	defer unlock()
+	var entry *pkgEntry
+	var entryDir string
+	for _, dirPath := range archDirs(branchDir, arch) {
+		found, entryErr := findPkgEntry(dirPath, name)
+		if entryErr == nil {
+			entry, entryDir = found, dirPath
+			break
 		}
-		for _, path := range paths {
-			rmFile(path)
+		if !os.IsNotExist(entryErr) {
+			logError(entryErr, "Unable to load pkg info of '%s' from '%s'", name, dirPath)
+			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
-	if rebuildErr := rebuildDatabase(branchDir, branch); rebuildErr != nil {
-		logError(rebuildErr, "Unable to rebuild database")
-		return c.NoContent(http.StatusInternalServerError)
+	if entry == nil {
+		return c.NoContent(http.StatusNotFound)
 	}
-	return c.NoContent(http.StatusOK)
+	if wantsJson(c) {
+		return c.JSON(http.StatusOK, struct {
+			*pkgSummary
+			Info *pkgInfo `json:"info"`
+		}{summarizePkg(entryDir, entry), &entry.Info})
+	}
+	return c.String(http.StatusOK, formatPkgInfo(entry))
 }
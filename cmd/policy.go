@@ -0,0 +1,122 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"path"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+type branchPolicy struct {
+	Name             string `toml:"name"`
+	Retention        *int   `toml:"retention"`
+	RequireSignature bool   `toml:"require_signature"`
+	ReadOnly         bool   `toml:"read_only"`
+	Quota            string `toml:"quota"`
+
+	quotaBytes int64
+}
+
+func loadPolicies(filePath string) ([]branchPolicy, error) {
+	var policiesFile struct {
+		Policies []branchPolicy `toml:"branch"`
+	}
+	if _, decodeErr := toml.DecodeFile(filePath, &policiesFile); decodeErr != nil {
+		return nil, fmt.Errorf("could not parse toml from '%s': %s", filePath, decodeErr)
+	}
+	if checkErr := checkPolicies(policiesFile.Policies, filePath); checkErr != nil {
+		return nil, checkErr
+	}
+	return policiesFile.Policies, nil
+}
+
+func checkPolicies(policies []branchPolicy, filePath string) error {
+	for i := range policies {
+		policy := &policies[i]
+		if _, matchErr := path.Match(policy.Name, ""); matchErr != nil || policy.Name == "" {
+			return fmt.Errorf("policy #%d in '%s' has invalid branch glob '%s'", i+1, filePath, policy.Name)
+		}
+		if policy.Retention != nil && *policy.Retention < 0 {
+			return fmt.Errorf("policy '%s' in '%s' has negative retention", policy.Name, filePath)
+		}
+		if policy.Quota != "" {
+			quota, sizeErr := parseSize(policy.Quota)
+			if sizeErr != nil {
+				return fmt.Errorf("policy '%s' in '%s' has %s", policy.Name, filePath, sizeErr)
+			}
+			policy.quotaBytes = quota
+		}
+	}
+	return nil
+}
+
+func policyFor(branch string) branchPolicy {
+	for _, policy := range serverCfg().Policies {
+		if matched, _ := path.Match(policy.Name, branch); matched {
+			return policy
+		}
+	}
+	return branchPolicy{Name: branch}
+}
+
+func (p branchPolicy) retention() int {
+	if p.Retention == nil {
+		return serverCfg().Retention
+	}
+	return *p.Retention
+}
+
+func checkQuota(branchDir, branch string) error {
+	quota := policyFor(branch).quotaBytes
+	if quota == 0 {
+		return nil
+	}
+	summary, summaryErr := summarizeBranch(branchDir)
+	if summaryErr != nil {
+		return summaryErr
+	}
+	if summary.Size > quota {
+		return fmt.Errorf("%w: '%s' would take %d bytes out of %d", errQuotaExceeded, branch, summary.Size, quota)
+	}
+	return nil
+}
+
+func quotaResponse(c echo.Context, quotaErr error) error {
+	if errors.Is(quotaErr, errQuotaExceeded) {
+		logInfo("Rejected '%s %s' from '%s': %s", c.Request().Method, c.Request().URL, c.RealIP(), quotaErr)
+		return c.NoContent(http.StatusInsufficientStorage)
+	}
+	logError(quotaErr, "Unable to check the quota")
+	return c.NoContent(http.StatusInternalServerError)
+}
+
+func writableBranch(branchOf func(echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if branch := branchOf(c); branch != "" && policyFor(branch).ReadOnly {
+				logInfo("Rejected '%s %s' from '%s': branch '%s' is read-only", c.Request().Method, c.Request().URL, c.RealIP(), branch)
+				return c.NoContent(http.StatusForbidden)
+			}
+			return next(c)
+		}
+	}
+}
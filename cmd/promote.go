@@ -0,0 +1,297 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func fromParam(c echo.Context) string {
+	return c.QueryParam("from")
+}
+
+func isMove(c echo.Context) bool {
+	return c.QueryParam("move") == "true"
+}
+
+func movedFrom(c echo.Context) string {
+	if isMove(c) {
+		return fromParam(c)
+	}
+	return ""
+}
+
+func promoteAuth() echo.MiddlewareFunc {
+	readAuth := authMiddleware(scopeRead, fromParam)
+	deleteAuth := authMiddleware(scopeDelete, fromParam)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		read, remove := readAuth(next), deleteAuth(next)
+		return func(c echo.Context) error {
+			if isMove(c) {
+				return remove(c)
+			}
+			return read(c)
+		}
+	}
+}
+
+func lockBranches(dirPaths []string, exclusive []bool) (func(), error) {
+	order := []int{0, 1}
+	if dirPaths[1] < dirPaths[0] {
+		order = []int{1, 0}
+	}
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, i := range order {
+		unlock, lockErr := lockBranch(dirPaths[i], exclusive[i])
+		if lockErr != nil {
+			unlockAll()
+			return nil, lockErr
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+func linkOrCopy(srcPath, dstPath string) error {
+	linkPath := filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+".tmp")
+	if linkErr := os.Link(srcPath, linkPath); linkErr == nil {
+		if renameErr := os.Rename(linkPath, dstPath); renameErr == nil {
+			return nil
+		}
+		rmFile(linkPath)
+	}
+	src, openErr := os.Open(srcPath)
+	if openErr != nil {
+		return openErr
+	}
+	stat, statErr := src.Stat()
+	if statErr != nil {
+		_ = src.Close()
+		return statErr
+	}
+	if saveErr := saveFile(dstPath, src); saveErr != nil {
+		return saveErr
+	}
+	return os.Chtimes(dstPath, stat.ModTime(), stat.ModTime())
+}
+
+func stagePackage(srcPath, dirPath string, entry *pkgEntry) (string, error) {
+	tmpPath := filepath.Join(dirPath, "tmp_"+entry.Filename+"_pmt")
+	if copyErr := linkOrCopy(srcPath, tmpPath); copyErr != nil {
+		return "", copyErr
+	}
+	if _, statErr := os.Stat(srcPath + sigExt); statErr == nil {
+		if copyErr := linkOrCopy(srcPath+sigExt, tmpPath+sigExt); copyErr != nil {
+			rmPackage(tmpPath)
+			return "", copyErr
+		}
+	}
+	if saveErr := saveCachedEntry(tmpPath, entry); saveErr != nil {
+		logError(saveErr, "Unable to cache metadata of '%s'", tmpPath)
+	}
+	return tmpPath, nil
+}
+
+type promotion struct {
+	fromDir string
+	toDir   string
+	entries []*pkgEntry
+}
+
+func promotePkgHandler(rootDir string, c echo.Context) error {
+	to := c.Param("branch")
+	from := fromParam(c)
+	names := c.QueryParam("name")
+	if to == "" || from == "" || names == "" || from == to {
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if !validBranchName(from) {
+		return rejectRequest(c, "branch", from)
+	}
+	for _, name := range strings.Split(names, ",") {
+		if !validPkgRef(name) {
+			return rejectRequest(c, "package", name)
+		}
+	}
+	move := isMove(c)
+	fromBranchDir := filepath.Join(rootDir, from)
+	toBranchDir := filepath.Join(rootDir, to)
+	unlock, lockErr := lockBranches([]string{fromBranchDir, toBranchDir}, []bool{move, true})
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s' and '%s'", fromBranchDir, toBranchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+
+	var promotions []promotion
+	var fromDirs, toDirs []string
+	found := make(map[string]bool)
+	for _, arch := range serverCfg().Archs {
+		current := promotion{fromDir: archPath(fromBranchDir, arch), toDir: archPath(toBranchDir, arch)}
+		for _, name := range strings.Split(names, ",") {
+			entry, entryErr := findPkgEntry(current.fromDir, name)
+			if entryErr != nil {
+				if os.IsNotExist(entryErr) {
+					continue
+				}
+				logError(entryErr, "Unable to load pkg info of '%s' from '%s'", name, current.fromDir)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			found[name] = true
+			current.entries = append(current.entries, entry)
+		}
+		if len(current.entries) > 0 {
+			promotions = append(promotions, current)
+			fromDirs = append(fromDirs, current.fromDir)
+			toDirs = append(toDirs, current.toDir)
+		}
+	}
+	for _, name := range strings.Split(names, ",") {
+		if !found[name] {
+			logInfo("No package '%s' in '%s'", name, fromBranchDir)
+			return c.NoContent(http.StatusNotFound)
+		}
+	}
+
+	if policyFor(to).RequireSignature {
+		for _, current := range promotions {
+			for _, entry := range current.entries {
+				if _, statErr := os.Stat(filepath.Join(current.fromDir, entry.Filename+sigExt)); statErr != nil {
+					logInfo("Branch '%s' requires signed packages, '%s' is not signed", to, entry.Filename)
+					return c.NoContent(http.StatusBadRequest)
+				}
+			}
+		}
+	}
+
+	var files []auditFile
+	var replaced []string
+	for _, current := range promotions {
+		for _, entry := range current.entries {
+			files = appendAuditFile(files, auditEntryFile(entry))
+			for _, name := range currentFiles([]string{current.toDir}, entry.Info.Name) {
+				if !slices.Contains(replaced, name) {
+					replaced = append(replaced, name)
+				}
+			}
+		}
+	}
+
+	var reverts []func()
+	var tmpPaths []string
+	var movedAway []pkgMove
+	rollback := func() {
+		for i := len(movedAway) - 1; i >= 0; i-- {
+			if moveErr := movePackage(movedAway[i].dstPath, movedAway[i].srcPath); moveErr != nil {
+				logError(moveErr, "Unable to move '%s' back to '%s'", movedAway[i].dstPath, movedAway[i].srcPath)
+			}
+		}
+		for i := len(reverts) - 1; i >= 0; i-- {
+			reverts[i]()
+		}
+		for _, path := range tmpPaths {
+			rmPackage(path)
+		}
+	}
+
+	for _, current := range promotions {
+		for _, entry := range current.entries {
+			srcPath := filepath.Join(current.fromDir, entry.Filename)
+			tmpPath, stageErr := stagePackage(srcPath, current.toDir, entry)
+			if stageErr != nil {
+				logError(stageErr, "Unable to copy '%s' to '%s'", srcPath, current.toDir)
+				rollback()
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			tmpPaths = append(tmpPaths, tmpPath)
+			revert, installErr := installPackage(current.toDir, tmpPath, entry.Filename, entry.Info.Name)
+			if installErr != nil {
+				logError(installErr, "Unable to install '%s' to '%s'", tmpPath, current.toDir)
+				rollback()
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			reverts = append(reverts, revert)
+		}
+	}
+	if move {
+		for _, current := range promotions {
+			for _, entry := range current.entries {
+				srcPath := filepath.Join(current.fromDir, entry.Filename)
+				tmpPath := filepath.Join(current.fromDir, "tmp_"+entry.Filename+"_pmt")
+				if moveErr := movePackage(srcPath, tmpPath); moveErr != nil {
+					logError(moveErr, "Unable to move '%s' away", srcPath)
+					rollback()
+					return c.NoContent(http.StatusInternalServerError)
+				}
+				movedAway = append(movedAway, pkgMove{srcPath, tmpPath})
+			}
+		}
+	}
+
+	if quotaErr := checkQuota(toBranchDir, to); quotaErr != nil {
+		rollback()
+		return quotaResponse(c, quotaErr)
+	}
+	if rebuildErr := rebuildDatabases(toDirs, to, rollback); rebuildErr != nil {
+		logError(rebuildErr, "Unable to rebuild databases of '%s'", toBranchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if move {
+		restore := func() {
+			rollback()
+			for _, dirPath := range toDirs {
+				if restoreErr := rebuildDatabase(dirPath, to); restoreErr != nil {
+					logError(restoreErr, "Unable to restore database of '%s'", dirPath)
+				}
+			}
+		}
+		if rebuildErr := rebuildDatabases(fromDirs, from, restore); rebuildErr != nil {
+			logError(rebuildErr, "Unable to rebuild databases of '%s'", fromBranchDir)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, moved := range movedAway {
+			rmPackage(moved.dstPath)
+		}
+		for _, dirPath := range fromDirs {
+			pruneCache(dirPath)
+		}
+	}
+	for _, current := range promotions {
+		for _, entry := range current.entries {
+			pruneArchive(current.toDir, to, entry.Info.Name)
+			logInfo("Promoted '%s' from '%s' to '%s' for %s", entry.Filename, from, to, filepath.Base(current.toDir))
+		}
+	}
+	action := auditPackagePromote
+	if move {
+		action = auditPackageMove
+	}
+	recordAudit(c, auditEntry{Action: action, Branch: to, From: from, Files: files, Replaced: replaced})
+	return c.NoContent(http.StatusOK)
+}
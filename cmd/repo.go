@@ -0,0 +1,111 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const sigExt = ".sig"
+
+func isRepoFile(branch, name string) bool {
+	name = strings.TrimSuffix(name, sigExt)
+	if isPkgFile(name) {
+		return validPkgFile(name)
+	}
+	for _, suffix := range []string{".db", ".db.tar.gz", ".files", ".files.tar.gz"} {
+		if name == branch+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+func repoETag(modTime time.Time, size int64) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+func parseRepoETag(etag string) (time.Time, bool) {
+	var nanos, size int64
+	if _, scanErr := fmt.Sscanf(etag, `"%x-%x"`, &nanos, &size); scanErr != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
+
+func repoFileHandler(rootDir string, c echo.Context) error {
+	branch := c.Param("branch")
+	name := c.Param("file")
+	if branch == "" || name == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return rejectRequest(c, "file", name)
+	}
+	if !isRepoFile(branch, name) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	arch := c.Param("arch")
+	if arch == "" {
+		arch = serverCfg().Archs[0]
+	}
+	if !knownArch(arch) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	branchDir := filepath.Join(rootDir, branch)
+	unlock, lockErr := lockBranch(branchDir, false)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	path := filepath.Join(archPath(branchDir, arch), name)
+	fp, openErr := os.Open(path)
+	unlock()
+	if openErr != nil {
+		if os.IsNotExist(openErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(openErr, "Unable to open '%s'", path)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer func() {
+		if closeErr := fp.Close(); closeErr != nil {
+			logError(closeErr, "Unable to close '%s'", path)
+		}
+	}()
+	info, statErr := fp.Stat()
+	if statErr != nil {
+		logError(statErr, "Unable to stat '%s'", path)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !info.Mode().IsRegular() {
+		return c.NoContent(http.StatusNotFound)
+	}
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "application/octet-stream")
+	header.Set("ETag", repoETag(info.ModTime(), info.Size()))
+	http.ServeContent(c.Response(), c.Request(), name, info.ModTime(), fp)
+	return nil
+}
@@ -16,8 +16,11 @@ package main
 */
 
 import (
+	"context"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"log"
 	"net"
 	"net/http"
 	"os"
@@ -26,63 +29,186 @@ import (
 	"syscall"
 )
 
-var listenOn = ":31847"
-
-const notifySocket = "NOTIFY_SOCKET"
-
-func notifyReady() {
-	addr := &net.UnixAddr{Name: os.Getenv(notifySocket), Net: "unixgram"}
-	if addr.Name == "" {
-		return
+func runServer() error {
+	initNotify()
+	signPassphrase = os.Getenv(signPassphraseEnv)
+	_ = os.Unsetenv(signPassphraseEnv)
+	cfg, loadErr := loadServerConfig(serverConfigPath)
+	if loadErr != nil {
+		return loadErr
 	}
-	_ = os.Unsetenv(notifySocket)
-	conn, dialErr := net.DialUnix(addr.Net, nil, addr)
-	if dialErr != nil {
-		return
+	currentConfig.Store(cfg)
+	logServerConfig(cfg)
+	rootDir := cfg.Root
+	if migrateErr := migrateBranches(rootDir); migrateErr != nil {
+		return migrateErr
 	}
-	defer func() { _ = conn.Close() }()
-	_, _ = conn.Write([]byte("READY=1"))
-}
 
-func runServer(rootDir string) error {
 	engine := echo.New()
 	engine.HidePort = true
 	engine.HideBanner = true
-
-	if debugMode {
-		engine.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-			Format: "${method} ${uri}: ${status} ${error}.\n",
-		}))
+	engine.IPExtractor = echo.ExtractIPDirect()
+	engine.Use(validateBranchParam)
+	engine.Use(reportStatus)
+	engine.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		Skipper:   func(echo.Context) bool { return !serverCfg().Debug },
+		LogMethod: true,
+		LogURI:    true,
+		LogStatus: true,
+		LogError:  true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			if v.Error != nil {
+				logDebug("%s %s: %d %s", v.Method, v.URI, v.Status, v.Error)
+			} else {
+				logDebug("%s %s: %d", v.Method, v.URI, v.Status)
+			}
+			return nil
+		},
+	}))
+
+	auth := authMiddleware
+	writable := writableBranch(branchParam)
+
+	engine.GET("/branches", func(c echo.Context) error { return lsBranchesHandler(rootDir, c) },
+		auth(scopeRead, noBranch))
+	engine.POST("/branches", func(c echo.Context) error { return addBranchHandler(rootDir, c) },
+		auth(scopeAdmin, nameParam))
+	engine.DELETE("/branches", func(c echo.Context) error { return rmBranchHandler(rootDir, c) },
+		auth(scopeAdmin, nameParam), writableBranch(nameParam))
+	engine.GET("/branches/trash", func(c echo.Context) error { return lsTrashHandler(rootDir, c) },
+		auth(scopeAdmin, noBranch))
+	engine.POST("/branches/restore", func(c echo.Context) error { return restoreBranchHandler(rootDir, c) },
+		auth(scopeAdmin, trashBranch), writableBranch(trashBranch))
+
+	engine.GET("/packages/:branch", func(c echo.Context) error { return lsPkgsHandler(rootDir, c) },
+		auth(scopeRead, branchParam))
+	engine.POST("/packages/:branch", func(c echo.Context) error { return addPkgHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), writable)
+	engine.POST("/packages/:branch/batch", func(c echo.Context) error { return addBatchHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), writable)
+	engine.POST("/uploads/:branch", func(c echo.Context) error { return createUploadHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), writable)
+	engine.GET("/uploads/:branch/:id", func(c echo.Context) error { return uploadOffsetHandler(rootDir, c) },
+		auth(scopeUpload, branchParam))
+	engine.HEAD("/uploads/:branch/:id", func(c echo.Context) error { return uploadOffsetHandler(rootDir, c) },
+		auth(scopeUpload, branchParam))
+	engine.PUT("/uploads/:branch/:id", func(c echo.Context) error { return putChunkHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), writable)
+	engine.DELETE("/uploads/:branch/:id", func(c echo.Context) error { return rmUploadHandler(rootDir, c) },
+		auth(scopeUpload, branchParam))
+	engine.DELETE("/packages/:branch", func(c echo.Context) error { return rmPkgHandler(rootDir, c) },
+		auth(scopeDelete, branchParam), writable)
+	engine.POST("/packages/:branch/:name/rollback", func(c echo.Context) error { return rollbackPkgHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), writable)
+	engine.POST("/packages/:branch/promote", func(c echo.Context) error { return promotePkgHandler(rootDir, c) },
+		auth(scopeUpload, branchParam), promoteAuth(), writable, writableBranch(movedFrom))
+	engine.GET("/packages/:branch/:name/info", func(c echo.Context) error { return pkgInfoHandler(rootDir, c) },
+		auth(scopeRead, branchParam))
+
+	for _, route := range []string{"/repo/:branch/:file", "/repo/:branch/:arch/:file"} {
+		engine.GET(route, func(c echo.Context) error { return repoFileHandler(rootDir, c) },
+			auth(scopeRead, branchParam))
+		engine.HEAD(route, func(c echo.Context) error { return repoFileHandler(rootDir, c) },
+			auth(scopeRead, branchParam))
 	}
 
-	engine.GET("/branches", func(c echo.Context) error { return lsBranchesHandler(rootDir, c) })
-	engine.POST("/branches", func(c echo.Context) error { return addBranchHandler(rootDir, c) })
+	engine.GET("/keys", keysHandler)
+	engine.GET("/audit", auditHandler, auth(scopeAdmin, auditBranch))
 
-	engine.GET("/packages/:branch", func(c echo.Context) error { return lsPkgsHandler(rootDir, c) })
-	engine.POST("/packages/:branch", func(c echo.Context) error { return addPkgHandler(rootDir, c) })
-	engine.DELETE("/packages/:branch", func(c echo.Context) error { return rmPkgHandler(rootDir, c) })
+	server := &http.Server{Handler: engine, ErrorLog: log.New(serverLogWriter{}, "", 0)}
+	if cfg.TLS.Cert != "" {
+		server.TLSConfig = serverTLSConfig()
+	}
+	listeners, activationErr := activationListeners()
+	if activationErr != nil {
+		return activationErr
+	}
+	if len(listeners) > 0 {
+		logInfo("Using %d socket(s) passed by systemd instead of the listen addresses", len(listeners))
+	} else {
+		for _, address := range cfg.Listen {
+			listener, listenErr := net.Listen("tcp", address)
+			if listenErr != nil {
+				for _, other := range listeners {
+					_ = other.Close()
+				}
+				return listenErr
+			}
+			listeners = append(listeners, listener)
+		}
+	}
 
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		defer wg.Done()
-		notifyReady()
-		logInfo("Listening on '%s'", listenOn)
-		if srvErr := engine.Start(listenOn); srvErr != nil && srvErr != http.ErrServerClosed {
-			engine.Logger.Fatal("failed to shutdown server")
-		}
-	}()
-
-	<-signals
+	serveErrs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var srvErr error
+			if cfg.TLS.Cert != "" {
+				logInfo("Listening on '%s' with TLS", listener.Addr())
+				srvErr = server.ServeTLS(listener, "", "")
+			} else {
+				logInfo("Listening on '%s'", listener.Addr())
+				srvErr = server.Serve(listener)
+			}
+			if srvErr != nil && srvErr != http.ErrServerClosed {
+				serveErrs <- fmt.Errorf("failed to serve on '%s': %s", listener.Addr(), srvErr)
+			}
+		}()
+	}
+	notifyReady()
+	go watchdogLoop(rootDir)
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	var purgeWg sync.WaitGroup
+	for _, purgeLoop := range []func(context.Context, string){purgeTrashLoop, purgeUploadsLoop} {
+		purgeWg.Add(1)
+		go func() {
+			defer purgeWg.Done()
+			purgeLoop(purgeCtx, rootDir)
+		}()
+	}
 
-	if closeErr := engine.Close(); closeErr != nil {
-		engine.Logger.Fatal(closeErr)
+	var serveErr error
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if serverConfigPath == "" && serverDefaults.TokensFile == "" && serverDefaults.PoliciesFile == "" {
+					logInfo("No configuration, tokens or policies file given, nothing to reload")
+				} else {
+					reloadServerConfig()
+				}
+				continue
+			}
+			running = false
+		case serveErr = <-serveErrs:
+			running = false
+		}
 	}
 
+	notifyStopping()
+	stopPurge()
+	drainTimeout := serverCfg().DrainTimeout
+	logInfo("Shutting down, waiting for the requests in progress")
+	ctx := context.Background()
+	if drainTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drainTimeout)
+		defer cancel()
+	}
+	shutdownErr := server.Shutdown(ctx)
+	if shutdownErr != nil {
+		logError(shutdownErr, "Requests still in progress after %s, closing their connections", drainTimeout)
+		if closeErr := server.Close(); closeErr != nil {
+			logError(closeErr, "Unable to close the server")
+		}
+	}
+	purgeWg.Wait()
+	waitWriters()
 	wg.Wait()
-	return nil
+	return serveErr
 }
@@ -0,0 +1,172 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+)
+
+const (
+	signPassphraseEnv = "ARPM_SIGN_PASSPHRASE"
+	signatureHeader   = "X-Package-Signature"
+)
+
+var signPassphrase string
+
+func readKeyRing(filePath string) (openpgp.EntityList, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	if entities, armorErr := openpgp.ReadArmoredKeyRing(bytes.NewReader(content)); armorErr == nil {
+		return entities, nil
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+func loadSigningKey(filePath string) (*openpgp.Entity, error) {
+	entities, readErr := readKeyRing(filePath)
+	if readErr != nil {
+		return nil, fmt.Errorf("could not read key from '%s': %s", filePath, readErr)
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("no private key in '%s'", filePath)
+	}
+	entity := entities[0]
+	if entity.PrivateKey.Encrypted {
+		if signPassphrase == "" {
+			return nil, fmt.Errorf("key in '%s' is encrypted and %s is not set", filePath, signPassphraseEnv)
+		}
+		if decryptErr := entity.DecryptPrivateKeys([]byte(signPassphrase)); decryptErr != nil {
+			return nil, fmt.Errorf("could not decrypt key from '%s': %s", filePath, decryptErr)
+		}
+	}
+	return entity, nil
+}
+
+func armorPublicKey(entity *openpgp.Entity) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, armorErr := armor.Encode(&buffer, openpgp.PublicKeyType, nil)
+	if armorErr != nil {
+		return nil, armorErr
+	}
+	if serializeErr := entity.Serialize(writer); serializeErr != nil {
+		return nil, serializeErr
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	return buffer.Bytes(), nil
+}
+
+func signFile(path string, key *openpgp.Entity) error {
+	fp, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() { _ = fp.Close() }()
+	var buffer bytes.Buffer
+	if signErr := openpgp.DetachSign(&buffer, key, fp, nil); signErr != nil {
+		return signErr
+	}
+	tmpPath := path + sigExt + ".tmp"
+	if writeErr := os.WriteFile(tmpPath, buffer.Bytes(), 0644); writeErr != nil {
+		rmFile(tmpPath)
+		return writeErr
+	}
+	return publishFile(tmpPath, path+sigExt)
+}
+
+func signMissing(pkgPaths []string, cfg *serverConfig) error {
+	if cfg.signingKey == nil || !cfg.SignPackages {
+		return nil
+	}
+	for _, path := range pkgPaths {
+		if _, statErr := os.Stat(path + sigExt); statErr == nil {
+			continue
+		}
+		logInfo("Signing '%s'", path)
+		if signErr := signFile(path, cfg.signingKey); signErr != nil {
+			return signErr
+		}
+	}
+	return nil
+}
+
+func verifySignature(path string, signature []byte) error {
+	trustedKeys := serverCfg().trustedKeys
+	if trustedKeys == nil {
+		return fmt.Errorf("no trusted keys")
+	}
+	fp, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer func() { _ = fp.Close() }()
+	signer, checkErr := openpgp.CheckDetachedSignature(trustedKeys, fp, bytes.NewReader(signature), nil)
+	if checkErr != nil {
+		return checkErr
+	}
+	for _, identity := range signer.Identities {
+		logInfo("Package '%s' is signed by '%s'", path, identity.Name)
+		break
+	}
+	return nil
+}
+
+func uploadedSignature(header http.Header, branch string) ([]byte, error) {
+	encoded := header.Get(signatureHeader)
+	if encoded == "" {
+		if policyFor(branch).RequireSignature {
+			return nil, fmt.Errorf("branch '%s' requires signed packages", branch)
+		}
+		return nil, nil
+	}
+	signature, decodeErr := base64.StdEncoding.DecodeString(encoded)
+	if decodeErr != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %s", decodeErr)
+	}
+	if parsed, parseErr := packet.Read(bytes.NewReader(signature)); parseErr != nil {
+		return nil, fmt.Errorf("invalid signature: %s", parseErr)
+	} else if _, isSignature := parsed.(*packet.Signature); !isSignature {
+		return nil, fmt.Errorf("invalid signature: not an OpenPGP signature packet")
+	}
+	return signature, nil
+}
+
+func readPgpSig(path string) string {
+	content, readErr := os.ReadFile(path + sigExt)
+	if readErr != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+func keysHandler(c echo.Context) error {
+	publicKey := serverCfg().publicKey
+	if publicKey == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.Blob(http.StatusOK, "application/pgp-keys", publicKey)
+}
@@ -0,0 +1,258 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logText = "text"
+	logJson = "json"
+)
+
+type tlsConfig struct {
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+	ClientCA   string `toml:"client_ca"`
+	ClientAuth string `toml:"client_auth"`
+}
+
+type serverConfig struct {
+	Root         string         `toml:"root"`
+	Listen       []string       `toml:"listen"`
+	Archs        []string       `toml:"archs"`
+	TLS          tlsConfig      `toml:"tls"`
+	Debug        bool           `toml:"debug"`
+	LogFormat    string         `toml:"log_format"`
+	RepoAdd      string         `toml:"repo_add"`
+	AuditLog     string         `toml:"audit_log"`
+	Retention    int            `toml:"retention"`
+	TrashKeep    time.Duration  `toml:"trash_keep"`
+	UploadKeep   time.Duration  `toml:"upload_keep"`
+	DrainTimeout time.Duration  `toml:"drain_timeout"`
+	SignKey      string         `toml:"sign_key"`
+	SignPackages bool           `toml:"sign_packages"`
+	Keyring      string         `toml:"keyring"`
+	TokensFile   string         `toml:"tokens_file"`
+	Tokens       []authToken    `toml:"token"`
+	PoliciesFile string         `toml:"policies_file"`
+	Policies     []branchPolicy `toml:"branch"`
+
+	authEnabled bool
+	signingKey  *openpgp.Entity
+	publicKey   []byte
+	trustedKeys openpgp.EntityList
+	clientCAs   *x509.CertPool
+}
+
+var (
+	serverConfigPath string
+	serverDefaults   = serverConfig{
+		Listen:       []string{":31847"},
+		Archs:        []string{"x86_64"},
+		LogFormat:    logText,
+		Retention:    1,
+		TrashKeep:    30 * 24 * time.Hour,
+		UploadKeep:   24 * time.Hour,
+		DrainTimeout: 30 * time.Second,
+	}
+	currentConfig atomic.Pointer[serverConfig]
+)
+
+func serverCfg() *serverConfig {
+	if cfg := currentConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &serverDefaults
+}
+
+func loadServerConfig(filePath string) (*serverConfig, error) {
+	cfg := serverDefaults
+	cfg.Listen = slices.Clone(cfg.Listen)
+	cfg.Archs = slices.Clone(cfg.Archs)
+	if filePath != "" {
+		meta, decodeErr := toml.DecodeFile(filePath, &cfg)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("could not parse toml from '%s': %s", filePath, decodeErr)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown setting '%s' in '%s'", undecoded[0], filePath)
+		}
+	} else {
+		filePath = "the command line"
+	}
+	if cfg.Root == "" {
+		return nil, fmt.Errorf("no root directory in %s", filePath)
+	}
+	if len(cfg.Listen) == 0 {
+		return nil, fmt.Errorf("no listen addresses in %s", filePath)
+	}
+	if archErr := checkArchs(cfg.Archs); archErr != nil {
+		return nil, archErr
+	}
+	if tlsErr := checkTLS(&cfg, filePath); tlsErr != nil {
+		return nil, tlsErr
+	}
+	if cfg.LogFormat != logText && cfg.LogFormat != logJson {
+		return nil, fmt.Errorf("unknown log format '%s' in %s", cfg.LogFormat, filePath)
+	}
+	if cfg.Retention < 0 {
+		return nil, fmt.Errorf("negative retention in %s", filePath)
+	}
+	if cfg.DrainTimeout < 0 {
+		return nil, fmt.Errorf("negative drain timeout in %s", filePath)
+	}
+	if tokensErr := checkTokens(cfg.Tokens, filePath); tokensErr != nil {
+		return nil, tokensErr
+	}
+	if cfg.TokensFile != "" {
+		tokens, tokensErr := loadTokens(cfg.TokensFile)
+		if tokensErr != nil {
+			return nil, tokensErr
+		}
+		cfg.Tokens = append(slices.Clip(cfg.Tokens), tokens...)
+	}
+	cfg.authEnabled = cfg.TokensFile != "" || len(cfg.Tokens) > 0
+	if policiesErr := checkPolicies(cfg.Policies, filePath); policiesErr != nil {
+		return nil, policiesErr
+	}
+	if cfg.PoliciesFile != "" {
+		policies, policiesErr := loadPolicies(cfg.PoliciesFile)
+		if policiesErr != nil {
+			return nil, policiesErr
+		}
+		cfg.Policies = append(slices.Clip(cfg.Policies), policies...)
+	}
+	if cfg.SignKey != "" {
+		var keyErr error
+		if cfg.signingKey, keyErr = loadSigningKey(cfg.SignKey); keyErr != nil {
+			return nil, keyErr
+		}
+		if cfg.publicKey, keyErr = armorPublicKey(cfg.signingKey); keyErr != nil {
+			return nil, keyErr
+		}
+	}
+	if cfg.Keyring != "" {
+		var keyringErr error
+		if cfg.trustedKeys, keyringErr = readKeyRing(cfg.Keyring); keyringErr != nil {
+			return nil, fmt.Errorf("could not read keyring from '%s': %s", cfg.Keyring, keyringErr)
+		}
+	}
+	return &cfg, nil
+}
+
+func checkTLS(cfg *serverConfig, filePath string) error {
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("both TLS certificate and key are required in %s", filePath)
+	}
+	if cfg.TLS.Cert == "" {
+		if cfg.TLS.ClientCA != "" || cfg.TLS.ClientAuth != "" {
+			return fmt.Errorf("client certificates require TLS in %s", filePath)
+		}
+		return nil
+	}
+	if _, certErr := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key); certErr != nil {
+		return fmt.Errorf("could not load certificate from '%s': %s", cfg.TLS.Cert, certErr)
+	}
+	if cfg.TLS.ClientAuth == "" {
+		cfg.TLS.ClientAuth = clientAuthNone
+		if cfg.TLS.ClientCA != "" {
+			cfg.TLS.ClientAuth = clientAuthOptional
+		}
+	}
+	if _, found := clientAuthTypes[cfg.TLS.ClientAuth]; !found {
+		return fmt.Errorf("unknown client authentication '%s' in %s", cfg.TLS.ClientAuth, filePath)
+	}
+	if cfg.TLS.ClientCA == "" {
+		if cfg.TLS.ClientAuth != clientAuthNone {
+			return fmt.Errorf("client authentication requires a client CA bundle in %s", filePath)
+		}
+		return nil
+	}
+	var poolErr error
+	if cfg.clientCAs, poolErr = readCertPool(cfg.TLS.ClientCA); poolErr != nil {
+		return fmt.Errorf("could not read client CA bundle from '%s': %s", cfg.TLS.ClientCA, poolErr)
+	}
+	return nil
+}
+
+func logServerConfig(cfg *serverConfig) {
+	if cfg.authEnabled {
+		logInfo("Loaded %d token(s)", len(cfg.Tokens))
+	} else {
+		logInfo("No tokens given, authorization is disabled")
+	}
+	if len(cfg.Policies) > 0 {
+		logInfo("Loaded %d branch policies", len(cfg.Policies))
+	}
+	if cfg.signingKey != nil {
+		logInfo("Signing with key %s from '%s'", cfg.signingKey.PrimaryKey.KeyIdString(), cfg.SignKey)
+	}
+	if cfg.trustedKeys != nil {
+		logInfo("Loaded %d trusted key(s) from '%s'", len(cfg.trustedKeys), cfg.Keyring)
+	}
+}
+
+func reloadServerConfig() {
+	if serverConfigPath != "" {
+		logInfo("Reloading configuration from '%s'", serverConfigPath)
+	} else {
+		logInfo("Reloading the tokens and the policies files")
+	}
+	cfg, loadErr := loadServerConfig(serverConfigPath)
+	if loadErr != nil {
+		logError(loadErr, "Unable to reload configuration, keeping the current one")
+		return
+	}
+	current := serverCfg()
+	if cfg.Root != current.Root || !slices.Equal(cfg.Listen, current.Listen) || !slices.Equal(cfg.Archs, current.Archs) {
+		logInfo("The root directory, the listen addresses and the architectures need a restart")
+		cfg.Root, cfg.Listen, cfg.Archs = current.Root, current.Listen, current.Archs
+	}
+	if (cfg.TLS.Cert == "") != (current.TLS.Cert == "") {
+		logInfo("Enabling or disabling TLS needs a restart")
+		cfg.TLS, cfg.clientCAs = current.TLS, current.clientCAs
+	}
+	currentConfig.Store(cfg)
+	logServerConfig(cfg)
+	logInfo("Configuration reloaded")
+}
+
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	shift := 0
+	if number != "" {
+		if unit := strings.IndexByte("KMGT", number[len(number)-1]); unit >= 0 {
+			shift = 10 * (unit + 1)
+			number = strings.TrimSpace(number[:len(number)-1])
+		}
+	}
+	result, parseErr := strconv.ParseInt(number, 10, 64)
+	if parseErr != nil || result < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return result << shift, nil
+}
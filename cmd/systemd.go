@@ -0,0 +1,178 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	notifySocket   = "NOTIFY_SOCKET"
+	listenPid      = "LISTEN_PID"
+	listenFds      = "LISTEN_FDS"
+	listenFdNames  = "LISTEN_FDNAMES"
+	watchdogUsec   = "WATCHDOG_USEC"
+	watchdogPid    = "WATCHDOG_PID"
+	listenFdsStart = 3
+)
+
+var notifyAddr *net.UnixAddr
+
+func initNotify() {
+	if name := os.Getenv(notifySocket); name != "" {
+		notifyAddr = &net.UnixAddr{Name: name, Net: "unixgram"}
+	}
+	_ = os.Unsetenv(notifySocket)
+}
+
+func sdNotify(state string) {
+	if notifyAddr == nil {
+		return
+	}
+	conn, dialErr := net.DialUnix(notifyAddr.Net, nil, notifyAddr)
+	if dialErr != nil {
+		logDebug("Unable to notify systemd: %s", dialErr)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	if _, writeErr := conn.Write([]byte(state)); writeErr != nil {
+		logDebug("Unable to notify systemd: %s", writeErr)
+	}
+}
+
+func notifyReady() {
+	sdNotify("READY=1")
+}
+
+func notifyStopping() {
+	sdNotify("STOPPING=1")
+}
+
+func notifyStatus(format string, args ...any) {
+	sdNotify("STATUS=" + strings.ReplaceAll(fmt.Sprintf(format, args...), "\n", " "))
+}
+
+func envFor(name, pidName string) string {
+	value := os.Getenv(name)
+	pid := os.Getenv(pidName)
+	_ = os.Unsetenv(name)
+	_ = os.Unsetenv(pidName)
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return ""
+	}
+	return value
+}
+
+func activationListeners() ([]net.Listener, error) {
+	names := strings.Split(os.Getenv(listenFdNames), ":")
+	_ = os.Unsetenv(listenFdNames)
+	value := envFor(listenFds, listenPid)
+	if value == "" {
+		return nil, nil
+	}
+	count, parseErr := strconv.Atoi(value)
+	if parseErr != nil || count < 0 {
+		return nil, fmt.Errorf("invalid %s '%s'", listenFds, value)
+	}
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("fd %d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, listenErr := net.FileListener(file)
+		_ = file.Close()
+		if listenErr != nil {
+			for _, other := range listeners {
+				_ = other.Close()
+			}
+			return nil, fmt.Errorf("could not use socket '%s' passed by systemd: %s", name, listenErr)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func checkWritable(rootDir string) error {
+	fp, createErr := os.CreateTemp(rootDir, ".health-")
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := fp.WriteString("ok")
+	if closeErr := fp.Close(); writeErr == nil {
+		writeErr = closeErr
+	}
+	if rmErr := os.Remove(fp.Name()); writeErr == nil {
+		writeErr = rmErr
+	}
+	return writeErr
+}
+
+func watchdogLoop(rootDir string) {
+	value := envFor(watchdogUsec, watchdogPid)
+	if value == "" {
+		return
+	}
+	usec, parseErr := strconv.ParseInt(value, 10, 64)
+	if parseErr != nil || usec <= 0 {
+		logError(parseErr, "Invalid %s '%s', the watchdog is not pinged", watchdogUsec, value)
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logInfo("Pinging the watchdog every %s", interval)
+	healthy := true
+	for {
+		if checkErr := checkWritable(rootDir); checkErr != nil {
+			if healthy {
+				logError(checkErr, "Root directory '%s' is not writable", rootDir)
+				notifyStatus("Root directory '%s' is not writable: %s", rootDir, checkErr)
+			}
+			healthy = false
+		} else {
+			if !healthy {
+				logInfo("Root directory '%s' is writable again", rootDir)
+			}
+			healthy = true
+			sdNotify("WATCHDOG=1")
+		}
+		time.Sleep(interval)
+	}
+}
+
+func reportStatus(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		handlerErr := next(c)
+		method := c.Request().Method
+		if method == http.MethodGet || method == http.MethodHead || notifyAddr == nil {
+			return handlerErr
+		}
+		who := c.RealIP()
+		if identity, ok := c.Get(identityKey).(string); ok {
+			who = identity
+		}
+		notifyStatus("%s %s by '%s': %d at %s", method, c.Request().URL, who, c.Response().Status,
+			time.Now().Format(time.DateTime))
+		return handlerErr
+	}
+}
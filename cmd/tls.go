@@ -0,0 +1,135 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequired = "required"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	clientAuthNone:     tls.NoClientCert,
+	clientAuthOptional: tls.VerifyClientCertIfGiven,
+	clientAuthRequired: tls.RequireAndVerifyClientCert,
+}
+
+func readCertPool(filePath string) (*x509.CertPool, error) {
+	content, readErr := os.ReadFile(filePath)
+	if readErr != nil {
+		return nil, readErr
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates in '%s'", filePath)
+	}
+	return pool, nil
+}
+
+type certReloader struct {
+	mutex    sync.Mutex
+	certPath string
+	keyPath  string
+	modTimes [2]time.Time
+	cert     *tls.Certificate
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	settings := serverCfg().TLS
+	var modTimes [2]time.Time
+	for i, path := range []string{settings.Cert, settings.Key} {
+		if stat, statErr := os.Stat(path); statErr == nil {
+			modTimes[i] = stat.ModTime()
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cert != nil && r.certPath == settings.Cert && r.keyPath == settings.Key && r.modTimes == modTimes {
+		return r.cert, nil
+	}
+	cert, loadErr := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+	if loadErr != nil {
+		if r.cert != nil {
+			logError(loadErr, "Unable to reload certificate '%s', keeping the current one", settings.Cert)
+			return r.cert, nil
+		}
+		return nil, loadErr
+	}
+	if r.cert != nil {
+		logInfo("Reloaded certificate '%s'", settings.Cert)
+	}
+	r.certPath, r.keyPath, r.modTimes, r.cert = settings.Cert, settings.Key, modTimes, &cert
+	return r.cert, nil
+}
+
+func serverTLSConfig() *tls.Config {
+	reloader := &certReloader{}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := serverCfg()
+			return &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: reloader.getCertificate,
+				ClientAuth:     clientAuthTypes[cfg.TLS.ClientAuth],
+				ClientCAs:      cfg.clientCAs,
+			}, nil
+		},
+	}
+}
+
+func certNames(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+func findCertToken(tokens []authToken, state *tls.ConnectionState) *authToken {
+	names := certNames(state)
+	if len(names) == 0 {
+		return nil
+	}
+	for i := range tokens {
+		for _, name := range tokens[i].Certificates {
+			if slices.Contains(names, name) {
+				return &tokens[i]
+			}
+		}
+	}
+	return nil
+}
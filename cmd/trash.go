@@ -0,0 +1,227 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	trashDirName    = ".trash"
+	trashTimeFormat = "20060102T150405.000Z"
+)
+
+type trashSummary struct {
+	Name    string    `json:"name"`
+	Branch  string    `json:"branch"`
+	Removed time.Time `json:"removed"`
+}
+
+func trashDir(rootDir string) string {
+	return filepath.Join(rootDir, trashDirName)
+}
+
+func parseTrashName(name string) (*trashSummary, error) {
+	sep := strings.LastIndex(name, "@")
+	if sep <= 0 {
+		return nil, fmt.Errorf("invalid trash entry '%s'", name)
+	}
+	removed, parseErr := time.Parse(trashTimeFormat, name[sep+1:])
+	if parseErr != nil {
+		return nil, fmt.Errorf("invalid trash entry '%s': %s", name, parseErr)
+	}
+	return &trashSummary{Name: name, Branch: name[:sep], Removed: removed}, nil
+}
+
+func trashBranch(c echo.Context) string {
+	name := nameParam(c)
+	if entry, parseErr := parseTrashName(name); parseErr == nil {
+		return entry.Branch
+	}
+	return name
+}
+
+func loadTrash(rootDir string) ([]*trashSummary, error) {
+	dirs, globErr := filepath.Glob(filepath.Join(trashDir(rootDir), "*"))
+	if globErr != nil {
+		return nil, globErr
+	}
+	entries := []*trashSummary{}
+	for _, dirPath := range dirs {
+		entry, parseErr := parseTrashName(filepath.Base(dirPath))
+		if parseErr != nil {
+			logError(parseErr, "Skipping '%s'", dirPath)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Removed.After(entries[j].Removed) })
+	return entries, nil
+}
+
+func rmBranchHandler(rootDir string, c echo.Context) error {
+	name := c.QueryParam("name")
+	if !validBranchName(name) {
+		return rejectRequest(c, "branch", name)
+	}
+	branchDir := filepath.Join(rootDir, name)
+	unlock, lockErr := lockBranch(branchDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	if mkErr := os.MkdirAll(trashDir(rootDir), 0755); mkErr != nil {
+		logError(mkErr, "Unable to create trash directory '%s'", trashDir(rootDir))
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	trashName := name + "@" + time.Now().UTC().Format(trashTimeFormat)
+	trashPath := filepath.Join(trashDir(rootDir), trashName)
+	logInfo("Moving branch '%s' to '%s'", branchDir, trashPath)
+	if renameErr := os.Rename(branchDir, trashPath); renameErr != nil {
+		logError(renameErr, "Unable to move '%s' to '%s'", branchDir, trashPath)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	recordAudit(c, auditEntry{Action: auditBranchRemove, Branch: name, Files: []auditFile{{Name: trashName}}})
+	return c.String(http.StatusOK, trashName)
+}
+
+func lsTrashHandler(rootDir string, c echo.Context) error {
+	entries, loadErr := loadTrash(rootDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load trash in '%s'", rootDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if wantsJson(c) {
+		return c.JSON(http.StatusOK, entries)
+	}
+	var result []string
+	for _, entry := range entries {
+		result = append(result, fmt.Sprintf("%s: removed %s", entry.Name, entry.Removed.Format(time.RFC1123)))
+	}
+	if len(result) == 0 {
+		return c.String(http.StatusOK, "No entries.")
+	}
+	return c.String(http.StatusOK, strings.Join(result, "\n"))
+}
+
+func restoreBranchHandler(rootDir string, c echo.Context) error {
+	name := c.QueryParam("name")
+	if !validBranchName(name) {
+		if entry, parseErr := parseTrashName(name); parseErr != nil || !validBranchName(entry.Branch) {
+			return rejectRequest(c, "trash entry", name)
+		}
+	}
+	entries, loadErr := loadTrash(rootDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load trash in '%s'", rootDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var target *trashSummary
+	for _, entry := range entries {
+		if entry.Name == name || entry.Branch == name {
+			target = entry
+			break
+		}
+	}
+	if target == nil {
+		logInfo("No '%s' in the trash", name)
+		return c.NoContent(http.StatusNotFound)
+	}
+	trashPath := filepath.Join(trashDir(rootDir), target.Name)
+	branchDir := filepath.Join(rootDir, target.Branch)
+	unlock, lockErr := lockBranch(rootDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", rootDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, statErr := os.Lstat(branchDir); statErr == nil {
+		unlock()
+		logInfo("Unable to restore '%s', branch '%s' exists", target.Name, target.Branch)
+		return c.NoContent(http.StatusConflict)
+	}
+	logInfo("Restoring branch '%s' from '%s'", branchDir, trashPath)
+	if renameErr := os.Rename(trashPath, branchDir); renameErr != nil {
+		unlock()
+		logError(renameErr, "Unable to move '%s' to '%s'", trashPath, branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	unlockBranch, branchLockErr := lockBranch(branchDir, true)
+	unlock()
+	recordAudit(c, auditEntry{Action: auditBranchRestore, Branch: target.Branch, Files: []auditFile{{Name: target.Name}}})
+	if branchLockErr != nil {
+		logError(branchLockErr, "Unable to lock '%s'", branchDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlockBranch()
+	if migrateErr := migrateBranch(branchDir); migrateErr != nil {
+		logError(migrateErr, "Unable to migrate branch '%s'", branchDir)
+	}
+	return c.String(http.StatusOK, target.Branch)
+}
+
+func purgeTrash(rootDir string) {
+	trashKeep := serverCfg().TrashKeep
+	if trashKeep <= 0 {
+		return
+	}
+	entries, loadErr := loadTrash(rootDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load trash in '%s'", rootDir)
+		return
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Removed) < trashKeep {
+			continue
+		}
+		purgeTrashEntry(rootDir, filepath.Join(trashDir(rootDir), entry.Name))
+	}
+}
+
+func purgeTrashEntry(rootDir, trashPath string) {
+	unlock, lockErr := lockBranch(rootDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", rootDir)
+		return
+	}
+	defer unlock()
+	logInfo("Purging '%s'", trashPath)
+	if rmErr := os.RemoveAll(trashPath); rmErr != nil {
+		logError(rmErr, "Unable to remove '%s'", trashPath)
+	}
+}
+
+func purgeTrashLoop(ctx context.Context, rootDir string) {
+	for {
+		purgeTrash(rootDir)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
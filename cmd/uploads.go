@@ -0,0 +1,372 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	uploadsDirName      = ".uploads"
+	offsetHeader        = "X-Upload-Offset"
+	batchUploadPartName = "upload"
+)
+
+type uploadSession struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256"`
+	Signature string    `json:"signature,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+func uploadsDir(branchDir string) string {
+	return filepath.Join(branchDir, uploadsDirName)
+}
+
+func uploadId(name string, size int64, checksum string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d\n%s", name, size, checksum)))
+	return hex.EncodeToString(hash[:16])
+}
+
+func sessionDataPath(sessionDir string) string {
+	return filepath.Join(sessionDir, "data")
+}
+
+func loadSession(sessionDir string) (*uploadSession, int64, error) {
+	content, readErr := os.ReadFile(filepath.Join(sessionDir, "session.json"))
+	if readErr != nil {
+		return nil, 0, readErr
+	}
+	var session uploadSession
+	if parseErr := json.Unmarshal(content, &session); parseErr != nil {
+		return nil, 0, parseErr
+	}
+	stat, statErr := os.Stat(sessionDataPath(sessionDir))
+	if statErr != nil {
+		return nil, 0, statErr
+	}
+	return &session, stat.Size(), nil
+}
+
+func (s *uploadSession) header() http.Header {
+	header := make(http.Header)
+	header.Set(checksumHeader, s.Sha256)
+	if s.Signature != "" {
+		header.Set(signatureHeader, s.Signature)
+	}
+	return header
+}
+
+func createUploadHandler(rootDir string, c echo.Context) error {
+	branch := c.Param("branch")
+	if branch == "" {
+		return c.NoContent(http.StatusNotFound)
+	}
+	name := c.QueryParam("name")
+	if !validPkgFile(name) {
+		return rejectRequest(c, "package file", name)
+	}
+	size, sizeErr := strconv.ParseInt(c.QueryParam("size"), 10, 64)
+	if sizeErr != nil || size <= 0 {
+		return rejectRequest(c, "size", c.QueryParam("size"))
+	}
+	checksum := c.Request().Header.Get(checksumHeader)
+	if !validSha256(checksum) {
+		return rejectRequest(c, "checksum", checksum)
+	}
+	branchDir := filepath.Join(rootDir, branch)
+	if _, statErr := os.Stat(branchDir); statErr != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if _, sigErr := uploadedSignature(c.Request().Header, branch); sigErr != nil {
+		logError(sigErr, "Rejected upload of '%s' for '%s'", name, branch)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	if quota := policyFor(branch).quotaBytes; quota > 0 && size > quota {
+		logInfo("Rejected upload of '%s' for '%s': %d bytes are over the quota", name, branch, size)
+		return c.NoContent(http.StatusInsufficientStorage)
+	}
+	id := uploadId(name, size, checksum)
+	sessionDir := filepath.Join(uploadsDir(branchDir), id)
+	if mkErr := os.MkdirAll(sessionDir, 0755); mkErr != nil {
+		logError(mkErr, "Unable to create upload directory '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	unlock, lockErr := lockSession(sessionDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	if _, offset, loadErr := loadSession(sessionDir); loadErr == nil {
+		logInfo("Resuming upload '%s' of '%s' at %d", id, name, offset)
+		c.Response().Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+		return c.String(http.StatusOK, id)
+	}
+	session := uploadSession{
+		Name:      name,
+		Size:      size,
+		Sha256:    checksum,
+		Signature: c.Request().Header.Get(signatureHeader),
+		Created:   time.Now().UTC(),
+	}
+	content, jsonErr := json.Marshal(&session)
+	if jsonErr != nil {
+		logError(jsonErr, "Unable to serialize upload '%s'", id)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if writeErr := os.WriteFile(sessionDataPath(sessionDir), nil, 0644); writeErr != nil {
+		logError(writeErr, "Unable to create upload '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if writeErr := os.WriteFile(filepath.Join(sessionDir, "session.json"), content, 0644); writeErr != nil {
+		logError(writeErr, "Unable to create upload '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	logInfo("Created upload '%s' of '%s' (%d bytes) for '%s'", id, name, size, branch)
+	c.Response().Header().Set(offsetHeader, "0")
+	return c.String(http.StatusCreated, id)
+}
+
+func sessionDirParam(rootDir string, c echo.Context) string {
+	id := c.Param("id")
+	if !validUploadId(id) {
+		return ""
+	}
+	return filepath.Join(uploadsDir(filepath.Join(rootDir, c.Param("branch"))), id)
+}
+
+func uploadOffsetHandler(rootDir string, c echo.Context) error {
+	sessionDir := sessionDirParam(rootDir, c)
+	if sessionDir == "" {
+		return rejectRequest(c, "upload", c.Param("id"))
+	}
+	unlock, lockErr := lockSession(sessionDir, false)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	session, offset, loadErr := loadSession(sessionDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load upload '%s'", sessionDir)
+		return c.NoContent(http.StatusNotFound)
+	}
+	c.Response().Header().Set(offsetHeader, strconv.FormatInt(offset, 10))
+	if wantsJson(c) {
+		return c.JSON(http.StatusOK, struct {
+			*uploadSession
+			Offset int64 `json:"offset"`
+		}{session, offset})
+	}
+	return c.String(http.StatusOK, strconv.FormatInt(offset, 10))
+}
+
+func putChunkHandler(rootDir string, c echo.Context) error {
+	sessionDir := sessionDirParam(rootDir, c)
+	if sessionDir == "" {
+		return rejectRequest(c, "upload", c.Param("id"))
+	}
+	offset, offsetErr := strconv.ParseInt(c.QueryParam("offset"), 10, 64)
+	if offsetErr != nil || offset < 0 {
+		return rejectRequest(c, "offset", c.QueryParam("offset"))
+	}
+	unlock, lockErr := lockSession(sessionDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	session, current, loadErr := loadSession(sessionDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load upload '%s'", sessionDir)
+		return c.NoContent(http.StatusNotFound)
+	}
+	c.Response().Header().Set(offsetHeader, strconv.FormatInt(current, 10))
+	if offset != current {
+		logInfo("Upload '%s' is at %d, not at %d", sessionDir, current, offset)
+		return c.NoContent(http.StatusConflict)
+	}
+	fp, openErr := os.OpenFile(sessionDataPath(sessionDir), os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		logError(openErr, "Unable to open upload '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer func() { _ = fp.Close() }()
+	written, copyErr := io.Copy(fp, io.LimitReader(c.Request().Body, session.Size-current+1))
+	if syncErr := fp.Sync(); syncErr != nil {
+		logError(syncErr, "Unable to sync upload '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if current+written > session.Size {
+		logInfo("Upload '%s' is longer than %d bytes", sessionDir, session.Size)
+		if truncErr := fp.Truncate(session.Size); truncErr != nil {
+			logError(truncErr, "Unable to truncate upload '%s'", sessionDir)
+		}
+		c.Response().Header().Set(offsetHeader, strconv.FormatInt(session.Size, 10))
+		return c.NoContent(http.StatusBadRequest)
+	}
+	c.Response().Header().Set(offsetHeader, strconv.FormatInt(current+written, 10))
+	if copyErr != nil {
+		logError(copyErr, "Upload '%s' interrupted at %d", sessionDir, current+written)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	logDebug("Upload '%s' is at %d of %d", sessionDir, current+written, session.Size)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func rmUploadHandler(rootDir string, c echo.Context) error {
+	sessionDir := sessionDirParam(rootDir, c)
+	if sessionDir == "" {
+		return rejectRequest(c, "upload", c.Param("id"))
+	}
+	unlock, lockErr := lockSession(sessionDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer unlock()
+	logInfo("Removing upload '%s'", sessionDir)
+	if rmErr := os.RemoveAll(sessionDir); rmErr != nil {
+		logError(rmErr, "Unable to remove '%s'", sessionDir)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func receiveUpload(branchDir, branch, id string) (*pendingPkg, int) {
+	if !validUploadId(id) {
+		logInfo("Rejected invalid upload '%s' for '%s'", id, branch)
+		return nil, http.StatusBadRequest
+	}
+	sessionDir := filepath.Join(uploadsDir(branchDir), id)
+	unlock, lockErr := lockSession(sessionDir, true)
+	if lockErr != nil {
+		if os.IsNotExist(lockErr) {
+			logInfo("No upload '%s' in '%s'", id, branch)
+			return nil, http.StatusNotFound
+		}
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return nil, http.StatusInternalServerError
+	}
+	defer unlock()
+	session, offset, loadErr := loadSession(sessionDir)
+	if loadErr != nil {
+		logError(loadErr, "Unable to load upload '%s'", sessionDir)
+		return nil, http.StatusNotFound
+	}
+	if offset != session.Size {
+		logInfo("Upload '%s' is incomplete: %d of %d bytes", sessionDir, offset, session.Size)
+		return nil, http.StatusConflict
+	}
+	signature, sigErr := uploadedSignature(session.header(), branch)
+	if sigErr != nil {
+		logError(sigErr, "Rejected upload '%s' for '%s'", sessionDir, branch)
+		logInfo("Removing upload '%s'", sessionDir)
+		if rmErr := os.RemoveAll(sessionDir); rmErr != nil {
+			logError(rmErr, "Unable to remove '%s'", sessionDir)
+		}
+		return nil, http.StatusBadRequest
+	}
+	tmpPath, tmpErr := createTmpPkg(branchDir)
+	if tmpErr != nil {
+		logError(tmpErr, "Unable to create temporary file in '%s'", branchDir)
+		return nil, http.StatusInternalServerError
+	}
+	if copyErr := linkOrCopy(sessionDataPath(sessionDir), tmpPath); copyErr != nil {
+		logError(copyErr, "Unable to copy upload '%s' to '%s'", sessionDir, tmpPath)
+		rmPackage(tmpPath)
+		return nil, http.StatusInternalServerError
+	}
+	pkg, status := checkPackage(tmpPath, branch, session.Name, session.Sha256, signature)
+	if pkg == nil && status == http.StatusBadRequest {
+		logInfo("Removing upload '%s'", sessionDir)
+		if rmErr := os.RemoveAll(sessionDir); rmErr != nil {
+			logError(rmErr, "Unable to remove '%s'", sessionDir)
+		}
+	}
+	return pkg, status
+}
+
+func rmUpload(branchDir, id string) {
+	sessionDir := filepath.Join(uploadsDir(branchDir), id)
+	unlock, lockErr := lockSession(sessionDir, true)
+	if lockErr != nil {
+		logError(lockErr, "Unable to lock '%s'", sessionDir)
+		return
+	}
+	defer unlock()
+	logInfo("Removing upload '%s'", sessionDir)
+	if rmErr := os.RemoveAll(sessionDir); rmErr != nil {
+		logError(rmErr, "Unable to remove '%s'", sessionDir)
+	}
+}
+
+func purgeUploads(rootDir string) {
+	dirs, globErr := filepath.Glob(filepath.Join(rootDir, "*", uploadsDirName, "*"))
+	if globErr != nil {
+		logError(globErr, "Unable to glob uploads in '%s'", rootDir)
+		return
+	}
+	uploadKeep := serverCfg().UploadKeep
+	for _, sessionDir := range dirs {
+		unlock, lockErr := lockSession(sessionDir, true)
+		if lockErr != nil {
+			continue
+		}
+		if stat, statErr := os.Stat(sessionDataPath(sessionDir)); statErr == nil && time.Since(stat.ModTime()) < uploadKeep {
+			unlock()
+			continue
+		}
+		logInfo("Purging upload '%s'", sessionDir)
+		if rmErr := os.RemoveAll(sessionDir); rmErr != nil {
+			logError(rmErr, "Unable to remove '%s'", sessionDir)
+		}
+		unlock()
+	}
+}
+
+func purgeUploadsLoop(ctx context.Context, rootDir string) {
+	for {
+		purgeUploads(rootDir)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"regexp"
+)
+
+var (
+	branchNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+	archNameRe   = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	pkgNameRe    = regexp.MustCompile(`^[A-Za-z0-9@_+][A-Za-z0-9@._+-]*$`)
+	sha256Re     = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	uploadIdRe   = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	pkgFileRe    = regexp.MustCompile(`^[A-Za-z0-9@_+][A-Za-z0-9@._+-]*-(?:[0-9]+:)?[A-Za-z0-9._+~]+-[0-9]+(?:\.[0-9]+)?-[A-Za-z0-9_]+` +
+		`\.pkg\.tar(?:\.(?:gz|bz2|xz|zst|lzo|lrz|lz4|lz|Z))?$`)
+)
+
+func validBranchName(name string) bool {
+	return branchNameRe.MatchString(name)
+}
+
+func validArchName(name string) bool {
+	return archNameRe.MatchString(name)
+}
+
+func validPkgName(name string) bool {
+	return pkgNameRe.MatchString(name)
+}
+
+func validPkgFile(name string) bool {
+	return pkgFileRe.MatchString(name)
+}
+
+func validSha256(value string) bool {
+	return sha256Re.MatchString(value)
+}
+
+func validUploadId(id string) bool {
+	return uploadIdRe.MatchString(id)
+}
+
+func validPkgRef(name string) bool {
+	if isPkgFile(name) {
+		return validPkgFile(name)
+	}
+	return validPkgName(name)
+}
+
+func rejectRequest(c echo.Context, what, value string) error {
+	logInfo("Rejected '%s %s' from '%s': invalid %s '%s'", c.Request().Method, c.Request().URL, c.RealIP(), what, value)
+	return c.NoContent(http.StatusBadRequest)
+}
+
+func validateBranchParam(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if branch := c.Param("branch"); branch != "" && !validBranchName(branch) {
+			return rejectRequest(c, "branch", branch)
+		}
+		return next(c)
+	}
+}
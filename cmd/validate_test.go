@@ -0,0 +1,128 @@
+package main
+
+/*
+   This file is part of arpm.
+
+   arpm is free software: you can redistribute it and/or modify it under the terms
+   of the GNU General Public License as published by the Free Software Foundation, either
+   version 3 of the License, or (at your option) any later version.
+
+   arpm is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY;
+   without even the implied warranty     of MERCHANTABILITY or FITNESS FOR A PARTICULAR
+   PURPOSE. See the GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License along with arpm.
+   If not, see <https://www.gnu.org/licenses/>.
+*/
+
+import (
+	"testing"
+)
+
+func TestValidBranchName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"stable", true},
+		{"testing-2.0", true},
+		{"a+b_c", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../../etc", false},
+		{".hidden", false},
+		{"a/b", false},
+		{"/stable", false},
+		{"stable/", false},
+		{"sta\x00ble", false},
+		{"sta ble", false},
+	}
+	for _, test := range tests {
+		if valid := validBranchName(test.name); valid != test.valid {
+			t.Errorf("validBranchName(%q) = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestValidPkgFile(t *testing.T) {
+	for _, ext := range pkgExts {
+		tests := []struct {
+			name  string
+			valid bool
+		}{
+			{"foo-1.0-1-x86_64" + ext, true},
+			{"foo-bar-1.0-1-any" + ext, true},
+			{"foo-2:1.0.r5.g1234-1.1-x86_64" + ext, true},
+			{"lib32-foo+extra@1-1.0_beta-2-x86_64" + ext, true},
+			{"foo-1.0-x86_64" + ext, false},
+			{"foo-1.0-1" + ext, false},
+			{"foo-1.0-rel-x86_64" + ext, false},
+			{"-1.0-1-x86_64" + ext, false},
+			{".foo-1.0-1-x86_64" + ext, false},
+			{"../foo-1.0-1-x86_64" + ext, false},
+			{"../../etc/foo-1.0-1-x86_64" + ext, false},
+			{"dir/foo-1.0-1-x86_64" + ext, false},
+			{"foo-1.0/2-1-x86_64" + ext, false},
+			{"foo-1.0-1-x86_64" + ext + "/..", false},
+			{"foo\x00-1.0-1-x86_64" + ext, false},
+			{"foo-1.0-1-x86_64" + ext + "\x00", false},
+			{"foo-1.0-1-x86_64" + ext + ".sig", false},
+			{"foo-1.0\x00-1-x86_64" + ext, false},
+			{"foo-1.0\"-1-x86_64" + ext, false},
+			{"foo-1.0'-1-x86_64" + ext, false},
+			{"foo-1.0*-1-x86_64" + ext, false},
+			{"foo-1.0?-1-x86_64" + ext, false},
+			{"foo-1.0[-1-x86_64" + ext, false},
+			{"foo-1.0]-1-x86_64" + ext, false},
+			{"foo-1.0$-1-x86_64" + ext, false},
+			{"foo-1.0\\-1-x86_64" + ext, false},
+			{"foo-1.0`-1-x86_64" + ext, false},
+			{"foo-1.0;-1-x86_64" + ext, false},
+			{"foo-1.0 -1-x86_64" + ext, false},
+			{"foo-1.0\n-1-x86_64" + ext, false},
+			{"foo-1.0%-1-x86_64" + ext, false},
+			{"foo-1.0~rc1+2-1-x86_64" + ext, true},
+			{ext, false},
+		}
+		for _, test := range tests {
+			if valid := validPkgFile(test.name); valid != test.valid {
+				t.Errorf("validPkgFile(%q) = %v, want %v", test.name, valid, test.valid)
+			}
+		}
+	}
+	for _, name := range []string{"", "foo", "foo-1.0-1-x86_64.pkg.tar.rar", "foo-1.0-1-x86_64.tar.zst"} {
+		if validPkgFile(name) {
+			t.Errorf("validPkgFile(%q) = true, want false", name)
+		}
+	}
+}
+
+func TestValidPkgRef(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"foo", true},
+		{"lib32-foo", true},
+		{"foo+extra", true},
+		{"foo-1.0-1-x86_64.pkg.tar.zst", true},
+		{"foo-1.0-1-any.pkg.tar", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../../etc", false},
+		{".foo", false},
+		{"-foo", false},
+		{"foo/bar", false},
+		{"fo\x00o", false},
+		{"foo-1.0-x86_64.pkg.tar.zst", false},
+		{"../foo-1.0-1-x86_64.pkg.tar.zst", false},
+		{"dir/foo-1.0-1-x86_64.pkg.tar.xz", false},
+	}
+	for _, test := range tests {
+		if valid := validPkgRef(test.name); valid != test.valid {
+			t.Errorf("validPkgRef(%q) = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}